@@ -0,0 +1,119 @@
+package shredis
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Pending is an Exec() which runs in the background. Make one with Shred.Go().
+type Pending struct {
+	done chan struct{}
+}
+
+// Go is Exec(), but it doesn't wait for the replies. It only blocks while the
+// queue of a shard is full (see OptionOverflow). The commands can be inspected
+// after the returned Pending is done.
+func (s *Shred) Go(cmds ...*Cmd) *Pending {
+	p := &Pending{
+		done: make(chan struct{}),
+	}
+	s.execAsync(cmds, func() { close(p.done) })
+	return p
+}
+
+// ExecAsync is Exec(), but it doesn't wait for the replies. It only blocks
+// while the queue of a shard is full (see OptionOverflow). `cb` is called when
+// all commands are done. That's usually from the goroutine which reads the
+// replies of a connection, so cb should be quick, and it should not Exec()
+// itself. Use Go() if that's a problem.
+func (s *Shred) ExecAsync(cb func(), cmds ...*Cmd) {
+	s.execAsync(cmds, cb)
+}
+
+// Done is closed when all commands are done.
+func (p *Pending) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until all commands are done, or until ctx is done. In that last
+// case it returns ctx's error, and the commands are still running.
+func (p *Pending) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// batch calls f when all actions of an async Exec are done. It runs in the
+// goroutine which finishes the last action.
+type batch struct {
+	n int32
+	f func()
+}
+
+func (b *batch) Done() {
+	if atomic.AddInt32(&b.n, -1) == 0 {
+		b.f()
+	}
+}
+
+// execAsync is ExecMode() with ReconnectDefault, but it calls done instead of
+// waiting. Only blocking commands and retries get a goroutine of their own.
+func (s *Shred) execAsync(cmds []*Cmd, done func()) {
+	if len(cmds) == 0 {
+		done()
+		return
+	}
+	var (
+		ctx   = context.Background()
+		queue = s.queue
+	)
+
+	cmds = acquireAll(cmds)
+	normal, blocking := splitBlocking(cmds)
+	var fills []nearFill
+	if s.near != nil {
+		normal, fills = s.near.get(s.ket, normal)
+	}
+	cs := s.sortedCmds(normal)
+	var gens []int
+	if s.retries > 0 {
+		gens = s.connGens()
+	}
+
+	finish := func() {
+		if s.near != nil {
+			s.near.fill(fills)
+		}
+		releaseAll(cmds)
+		done()
+	}
+	b := &batch{
+		n: int32(countSlots(cs)),
+		f: func() {
+			if s.retries > 0 && len(retryable(cs)) > 0 {
+				go func() {
+					s.retryFailed(ctx, queue, cs, gens)
+					finish()
+				}()
+				return
+			}
+			finish()
+		},
+	}
+	if len(cs) == 0 && len(blocking) == 0 {
+		// all from the near cache
+		b.f()
+		return
+	}
+	if len(blocking) > 0 {
+		b.n++
+		go func() {
+			s.execBlocking(ctx, blocking)
+			b.Done()
+		}()
+	}
+	s.sendSorted(ctx, queue, cs, b)
+}
@@ -0,0 +1,149 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func TestGo(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("foo", "bar")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	var (
+		gets    []*Cmd
+		pending []*Pending
+	)
+	for i := 0; i < 10; i++ {
+		get := BuildGet("foo")
+		gets = append(gets, get)
+		pending = append(pending, shr.Go(get))
+	}
+	for i, p := range pending {
+		<-p.Done()
+		v, err := gets[i].GetString()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if have, want := v, "bar"; have != want {
+			t.Fatalf("have %q, want %q", have, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.Go(BuildGet("foo")).Wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGoTimeout(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	defer shutdownNow(shr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if have, want := shr.Go(BuildGet("foo")).Wait(ctx), context.DeadlineExceeded; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+}
+
+func TestGoNoGoroutines(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	}, OptionQueueDepth(1000))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing ever replies, so all of these stay pending.
+	before := runtime.NumGoroutine()
+	var (
+		gets    []*Cmd
+		pending []*Pending
+	)
+	for i := 0; i < 100; i++ {
+		get := BuildGet("foo")
+		gets = append(gets, get)
+		pending = append(pending, shr.Go(get))
+	}
+	if have := runtime.NumGoroutine() - before; have > 10 {
+		t.Errorf("%d new goroutines", have)
+	}
+
+	shutdownNow(shr)
+	for i, p := range pending {
+		<-p.Done()
+		if _, err := gets[i].Get(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("have %v, want %v", err, ErrClosed)
+		}
+	}
+}
+
+func TestGoBlockingClosed(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	shr.Close()
+
+	// only a blocking command, which fails right away
+	for i := 0; i < 100; i++ {
+		pop := Build("list", "BLPOP", "list", "0")
+		<-shr.Go(pop).Done()
+		if _, err := pop.Get(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("have %v, want %v", err, ErrClosed)
+		}
+	}
+}
+
+func TestExecAsync(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	var (
+		set  = BuildSet("foo", "bar")
+		done = make(chan struct{})
+	)
+	shr.ExecAsync(func() {
+		close(done)
+	}, set)
+	<-done
+	if _, err := set.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, _ := mr.Get("foo"); have != "bar" {
+		t.Fatalf("have %q, want %q", have, "bar")
+	}
+}
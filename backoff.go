@@ -0,0 +1,52 @@
+package shredis
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffMin = 50 * time.Millisecond
+	defaultBackoffMax = 5 * time.Second
+)
+
+// backoff is an exponential backoff with jitter. Not goroutine safe.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = defaultBackoffMin
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{
+		min: min,
+		max: max,
+		cur: min,
+	}
+}
+
+// next gives how long to wait before the next attempt. Every call doubles the
+// wait, up to max. The returned duration is between half and all of that.
+func (b *backoff) next() time.Duration {
+	d := b.cur
+	if b.cur < b.max {
+		b.cur *= 2
+		if b.cur > b.max {
+			b.cur = b.max
+		}
+	}
+	if half := int64(d / 2); half > 0 {
+		return time.Duration(half + rand.Int63n(half+1))
+	}
+	return d
+}
+
+// reset starts over at min. Call this after a successful attempt.
+func (b *backoff) reset() {
+	b.cur = b.min
+}
@@ -0,0 +1,28 @@
+package shredis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(100*time.Millisecond, time.Second)
+	for i, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		have := b.next()
+		if have < want/2 || have > want {
+			t.Errorf("%d: have %s, want between %s and %s", i, have, want/2, want)
+		}
+	}
+
+	b.reset()
+	if have, want := b.next(), 100*time.Millisecond; have > want {
+		t.Errorf("have %s, want at most %s", have, want)
+	}
+}
@@ -57,6 +57,13 @@ func BenchmarkBuilding(b *testing.B) {
 	}
 }
 
+func BenchmarkBuildingPool(b *testing.B) {
+	var p CmdPool
+	for i := 0; i < b.N; i++ {
+		p.Put(p.Build("key1", "HSET", "key1", "aap", "noot"))
+	}
+}
+
 func BenchmarkNoPrepare(b *testing.B) {
 	sh := New(map[string]string{
 		"shard0": "localhost:6379",
@@ -0,0 +1,122 @@
+package shredis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocking commands (BLPOP, BRPOP, BLMOVE, BZPOPMIN, XREAD BLOCK, ...) are
+// detected by Build(), and Exec() runs them on dedicated connections, so they
+// don't hold up the other commands. The read deadline of the connection is the
+// timeout of the command, plus some slack. A timeout of 0 blocks until the
+// context of ExecMode() is done.
+
+// blockingLast are the blocking commands with the timeout, in seconds, as last
+// argument.
+var blockingLast = map[string]bool{
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BRPOPLPUSH": true,
+	"BLMOVE":     true,
+	"BZPOPMIN":   true,
+	"BZPOPMAX":   true,
+}
+
+// blockingFirst are the blocking commands with the timeout, in seconds, as
+// first argument.
+var blockingFirst = map[string]bool{
+	"BLMPOP": true,
+	"BZMPOP": true,
+}
+
+// OptionPoolSize is an option to New. It's the number of idle dedicated
+// connections kept per shard, for blocking commands and Shred.Conn(). Default
+// 2.
+func OptionPoolSize(n int) Option {
+	return func(s *Shred) {
+		s.poolSize = n
+	}
+}
+
+// blockTimeout gives how long a command can block. The bool is false for
+// commands which don't block.
+func blockTimeout(fields []string) (time.Duration, bool) {
+	if len(fields) < 2 {
+		return 0, false
+	}
+	cmd := strings.ToUpper(fields[0])
+	switch {
+	case blockingLast[cmd]:
+		return parseSeconds(fields[len(fields)-1]), true
+	case blockingFirst[cmd]:
+		return parseSeconds(fields[1]), true
+	case cmd == "XREAD" || cmd == "XREADGROUP":
+		for i, f := range fields[1 : len(fields)-1] {
+			if strings.EqualFold(f, "BLOCK") {
+				ms, _ := strconv.ParseInt(fields[i+2], 10, 64)
+				return time.Duration(ms) * time.Millisecond, true
+			}
+			if strings.EqualFold(f, "STREAMS") {
+				break
+			}
+		}
+	}
+	return 0, false
+}
+
+func parseSeconds(s string) time.Duration {
+	f, _ := strconv.ParseFloat(s, 64)
+	return time.Duration(f * float64(time.Second))
+}
+
+// splitBlocking splits off the blocking commands.
+func splitBlocking(cmds []*Cmd) ([]*Cmd, []*Cmd) {
+	var normal, blocking []*Cmd
+	for _, c := range cmds {
+		if c.blocking {
+			blocking = append(blocking, c)
+		} else {
+			normal = append(normal, c)
+		}
+	}
+	return normal, blocking
+}
+
+// execBlocking runs blocking commands, all at the same time and each on a
+// dedicated connection, and waits for them.
+func (s *Shred) execBlocking(ctx context.Context, cmds []*Cmd) {
+	var wg sync.WaitGroup
+	for _, c := range cmds {
+		wg.Add(1)
+		go func(c *Cmd) {
+			defer wg.Done()
+			slot := s.ket.Slot(c.hash)
+			// BLPOP and friends change their keys, and other Exec()s can
+			// cache them again while we wait.
+			s.near.dropWrites(slot, c)
+			s.execDedicated(ctx, s.shards[slot], c)
+			s.near.dropWrites(slot, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// execDedicated runs a single command on a connection from the pool.
+func (s *Shred) execDedicated(ctx context.Context, sh shard, c *Cmd) {
+	dc, err := sh.pool.get(ctx)
+	if err != nil {
+		c.setConnError(err)
+		return
+	}
+	timeout := time.Duration(0)
+	if c.block > 0 {
+		timeout = c.block + connTimeout
+	}
+	if err := dc.do(ctx, c, timeout); err != nil && sh.pool.isClosed() {
+		c.setConnError(ErrClosed)
+	}
+	sh.pool.put(dc)
+}
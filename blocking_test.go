@@ -0,0 +1,112 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func TestBlockTimeout(t *testing.T) {
+	for _, c := range []struct {
+		fields   []string
+		blocking bool
+		block    time.Duration
+	}{
+		{[]string{"GET", "foo"}, false, 0},
+		{[]string{"BLPOP", "foo", "bar", "1.5"}, true, 1500 * time.Millisecond},
+		{[]string{"brpop", "foo", "0"}, true, 0},
+		{[]string{"BLMOVE", "a", "b", "LEFT", "RIGHT", "2"}, true, 2 * time.Second},
+		{[]string{"BZMPOP", "3", "1", "z", "MIN"}, true, 3 * time.Second},
+		{[]string{"XREAD", "COUNT", "2", "BLOCK", "250", "STREAMS", "s", "$"}, true, 250 * time.Millisecond},
+		{[]string{"XREAD", "STREAMS", "block", "$"}, false, 0},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "s", ">"}, false, 0},
+	} {
+		block, blocking := blockTimeout(c.fields)
+		if blocking != c.blocking || block != c.block {
+			t.Errorf("%v: have %v %v, want %v %v", c.fields, blocking, block, c.blocking, c.block)
+		}
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	pop := Build("list", "BLPOP", "list", "0")
+	pending := shr.Go(pop)
+
+	// the shared connection is not blocked
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-pending.Done():
+		t.Fatal("BLPOP didn't block")
+	default:
+	}
+
+	shr.Exec(BuildRpush("list", "aap"))
+	<-pending.Done()
+	v, err := pop.GetStrings()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(v) != 2 || v[1] != "aap" {
+		t.Fatalf("have %v, want [list aap]", v)
+	}
+
+	// context cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pop = Build("list2", "BLPOP", "list2", "0")
+	shr.ExecMode(ctx, ReconnectDefault, pop)
+	if _, err := pop.Get(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+	// miniredis keeps blocking after the client is gone
+	shr.Exec(BuildRpush("list2", "aap"))
+
+	// timeouts
+	pop = Build("list", "BLPOP", "list", "1")
+	shr.Exec(pop)
+	if v, err := pop.Get(); err != nil || v != nil {
+		t.Fatalf("have %v %v, want a nil reply", v, err)
+	}
+}
+
+func TestBlockingClose(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+
+	pop := Build("list", "BLPOP", "list", "0")
+	pending := shr.Go(pop)
+	time.Sleep(20 * time.Millisecond)
+	shr.Close()
+	<-pending.Done()
+	if _, err := pop.Get(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v, want %v", err, ErrClosed)
+	}
+
+	pop = Build("list", "BLPOP", "list", "0")
+	shr.Exec(pop)
+	if _, err := pop.Get(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,220 @@
+package shredis
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error for commands to a shard whose circuit breaker is
+// open. See OptionBreaker.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// BreakerState is the state of the circuit breaker of a shard.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all commands through. This is the normal state.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all commands with ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through, which decides whether the
+	// breaker closes again.
+	BreakerHalfOpen
+)
+
+func (b BreakerState) String() string {
+	switch b {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig configures the circuit breakers. See OptionBreaker.
+type BreakerConfig struct {
+	// ErrorRate is the fraction of failed requests, between 0 and 1, which
+	// opens the breaker.
+	ErrorRate float64
+	// MinRequests is the minimum number of requests in a window before the
+	// breaker can open.
+	MinRequests int
+	// Window is the period over which the error rate is counted.
+	Window time.Duration
+	// Cooldown is how long the breaker stays open before it lets a probe
+	// through.
+	Cooldown time.Duration
+}
+
+// OptionBreaker is an option to New. It adds a circuit breaker to every shard.
+// If too many requests to a shard fail with connection errors the breaker
+// opens, and all commands for the shard fail right away with ErrCircuitOpen.
+// After the cooldown a single probe request is let through, and if that works
+// the breaker closes again. Keys are not moved to other shards.
+// Redis error replies (WRONGTYPE and such) don't count as failures. A request
+// is all commands for a shard in a single Exec().
+func OptionBreaker(c BreakerConfig) Option {
+	return func(s *Shred) {
+		s.breaker = &c
+	}
+}
+
+// breaker is a circuit breaker for a single shard. A nil breaker lets
+// everything through.
+type breaker struct {
+	c       BreakerConfig
+	onState func(BreakerState)
+
+	mu          sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	total, fail int
+	openedAt    time.Time
+	probing     bool
+}
+
+func newBreaker(c *BreakerConfig, onState func(BreakerState)) *breaker {
+	if c == nil {
+		return nil
+	}
+	return &breaker{
+		c:       *c,
+		onState: onState,
+	}
+}
+
+// getState is the current state.
+func (b *breaker) getState() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow is whether a request can be sent now. In the half-open state only
+// one request is allowed, until its result is recorded. probe is set for that
+// request, and has to be passed to record() and cancel().
+func (b *breaker) allow() (ok, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	from := b.state
+	ok, probe = b.allowLocked()
+	to := b.state
+	b.mu.Unlock()
+	if from != to {
+		b.onState(to)
+	}
+	return ok, probe
+}
+
+func (b *breaker) allowLocked() (bool, bool) {
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.c.Cooldown {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true, true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// cancel is for a request which was allowed, but never sent. If it was the
+// probe it frees the probe slot, without counting anything.
+func (b *breaker) cancel(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// record registers the result of a request which was allowed. In the
+// half-open state only the result of the probe counts, requests which were
+// sent before the breaker opened are ignored.
+func (b *breaker) record(probe, ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	from := b.state
+	b.recordLocked(probe, ok)
+	to := b.state
+	b.mu.Unlock()
+	if from != to {
+		b.onState(to)
+	}
+}
+
+func (b *breaker) recordLocked(probe, ok bool) {
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if !probe {
+			return
+		}
+		b.probing = false
+		if ok {
+			b.total, b.fail = 0, 0
+			b.windowStart = now
+			b.state = BreakerClosed
+			return
+		}
+		b.openedAt = now
+		b.state = BreakerOpen
+	case BreakerClosed:
+		if now.Sub(b.windowStart) > b.c.Window {
+			b.windowStart = now
+			b.total, b.fail = 0, 0
+		}
+		b.total++
+		if ok {
+			return
+		}
+		b.fail++
+		if b.total >= b.c.MinRequests && float64(b.fail) >= b.c.ErrorRate*float64(b.total) {
+			b.openedAt = now
+			b.state = BreakerOpen
+		}
+	}
+}
+
+// breakerEvents makes the callback which sends an event for every breaker
+// state change.
+func breakerEvents(label, addr string, events EventCB) func(BreakerState) {
+	return func(s BreakerState) {
+		t := EventBreakerClosed
+		switch s {
+		case BreakerOpen:
+			t = EventBreakerOpen
+		case BreakerHalfOpen:
+			t = EventBreakerHalfOpen
+		}
+		events(Event{
+			Type:  t,
+			Label: label,
+			Addr:  addr,
+			Time:  time.Now(),
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func TestBreaker(t *testing.T) {
+	var states []BreakerState
+	b := newBreaker(&BreakerConfig{
+		ErrorRate:   0.5,
+		MinRequests: 4,
+		Window:      time.Minute,
+		Cooldown:    10 * time.Millisecond,
+	}, func(s BreakerState) { states = append(states, s) })
+
+	for _, ok := range []bool{true, false, true, false} {
+		allowed, probe := b.allow()
+		if !allowed {
+			t.Fatalf("not allowed")
+		}
+		b.record(probe, ok)
+	}
+	if have, want := b.getState(), BreakerOpen; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if allowed, _ := b.allow(); allowed {
+		t.Fatalf("allowed")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	allowed, probe := b.allow()
+	if !allowed || !probe {
+		t.Fatalf("no probe allowed")
+	}
+	if have, want := b.getState(), BreakerHalfOpen; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if allowed, _ := b.allow(); allowed {
+		t.Fatalf("second probe allowed")
+	}
+	// a late result of a request from before the breaker opened
+	b.record(false, true)
+	if have, want := b.getState(), BreakerHalfOpen; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	b.record(true, false)
+	if have, want := b.getState(), BreakerOpen; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	allowed, probe = b.allow()
+	if !allowed || !probe {
+		t.Fatalf("no probe allowed")
+	}
+	b.record(true, true)
+	if have, want := b.getState(), BreakerClosed; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if have := states; len(have) != len(want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	for i := range want {
+		if have, want := states[i], want[i]; have != want {
+			t.Fatalf("have %v, want %v", states, want)
+		}
+	}
+}
+
+func TestBreakerShred(t *testing.T) {
+	shr := New(map[string]string{
+		"shard0": "localhost:1",
+	}, OptionBreaker(BreakerConfig{
+		ErrorRate:   0.5,
+		MinRequests: 3,
+		Window:      time.Minute,
+		Cooldown:    time.Minute,
+	}))
+	defer shr.Close()
+
+	for i := 0; i < 3; i++ {
+		get := BuildGet("foo")
+		shr.Exec(get)
+		if _, err := get.Get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("have %v, want %v", err, ErrCircuitOpen)
+	}
+	if have, want := shr.Status()[0].Breaker, BreakerOpen; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+}
+
+func TestBreakerQueuedProbe(t *testing.T) {
+	// closes connections until slow is set, after that it replies +OK to
+	// everything, slowly.
+	var slow int32
+	l := redistest.NewServer(t, func(c *redistest.Conn, args []string) string {
+		if atomic.LoadInt32(&slow) == 0 {
+			c.Close()
+			return ""
+		}
+		time.Sleep(300 * time.Millisecond)
+		return "+OK\r\n"
+	})
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	}, OptionAuth("secret"), OptionBackoff(50*time.Millisecond, 50*time.Millisecond), OptionBreaker(BreakerConfig{
+		ErrorRate:   0.5,
+		MinRequests: 1,
+		Window:      time.Minute,
+		Cooldown:    10 * time.Millisecond,
+	}))
+	defer shutdownNow(shr)
+
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if have, want := shr.Status()[0].Breaker, BreakerOpen; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+
+	// the probe is held, and its ctx expires during the handshake
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt32(&slow, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	get = BuildGet("foo")
+	shr.ExecMode(ctx, ReconnectQueue, get)
+	if _, err := get.Get(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// so the next probe is let through
+	time.Sleep(20 * time.Millisecond)
+	get = BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := shr.Status()[0].Breaker, BreakerClosed; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+}
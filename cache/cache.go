@@ -0,0 +1,342 @@
+// Package cache is a cache-aside helper on top of a shredis.Shred. Values are
+// plain strings in redis, stored with SET PX, so other clients can read them.
+//
+// Concurrent misses for the same key within a process are coalesced: only one
+// goroutine calls the loader, the others wait for its result. If that load
+// fails because the context of that goroutine is done, a waiter whose own
+// context is still fine loads the key itself.
+package cache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/alicebob/shredis"
+)
+
+// ErrNotFound can be returned by a Loader if there is no value for a key.
+// It's not cached. It's also what Get() returns for keys a BatchLoader didn't
+// return.
+var ErrNotFound = errors.New("cache: not found")
+
+var errPanic = errors.New("cache: loader panicked")
+
+// Loader loads the value for a key on a miss.
+type Loader func(ctx context.Context, key string) (string, error)
+
+// BatchLoader loads the values for many keys on a miss. Keys which are not in
+// the returned map are not cached.
+type BatchLoader func(ctx context.Context, keys []string) (map[string]string, error)
+
+// Option is an option to New()
+type Option func(*Cache)
+
+// OptionEarlyRefresh makes Get() refresh keys before they expire. In the last
+// `window` of a key's TTL a Get() will reload the key with a probability which
+// goes from 0 to 1 as the key gets closer to expiry. Other callers keep getting
+// the cached value while that happens, so hot keys never all expire at once.
+func OptionEarlyRefresh(window time.Duration) Option {
+	return func(c *Cache) {
+		c.early = window
+	}
+}
+
+// OptionStoreError adds a callback for values which could not be stored in
+// redis. Those values are still returned, a failed store only means the next
+// Get() will load them again.
+func OptionStoreError(cb func(key string, err error)) Option {
+	return func(c *Cache) {
+		c.storeErr = cb
+	}
+}
+
+// Cache is a cache-aside helper. Make one with New().
+type Cache struct {
+	shr      *shredis.Shred
+	early    time.Duration
+	storeErr func(key string, err error)
+	rand     func() float64
+	mu       sync.Mutex
+	calls    map[string]*call
+}
+
+// call is a load in progress.
+type call struct {
+	done chan struct{}
+	val  string
+	err  error
+}
+
+func (cl *call) wait(ctx context.Context) (string, error) {
+	select {
+	case <-cl.done:
+		return cl.val, cl.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// New makes a Cache.
+func New(shr *shredis.Shred, options ...Option) *Cache {
+	c := &Cache{
+		shr:   shr,
+		rand:  rand.Float64,
+		calls: map[string]*call{},
+	}
+	for _, o := range options {
+		o(c)
+	}
+	return c
+}
+
+// Get returns the value of `key`. On a miss it calls `load`, and stores the
+// value for `ttl`. Errors from the loader are returned as-is, and are not
+// cached. A value which can't be stored is returned all the same, see
+// OptionStoreError.
+func (c *Cache) Get(ctx context.Context, key string, ttl time.Duration, load Loader) (string, error) {
+	var (
+		get  = shredis.BuildGet(key)
+		pttl *shredis.Cmd
+		cmds = []*shredis.Cmd{get}
+	)
+	if c.early > 0 {
+		pttl = shredis.BuildPTTL(key)
+		cmds = append(cmds, pttl)
+	}
+	c.shr.ExecMode(ctx, shredis.ReconnectDefault, cmds...)
+	v, ok, err := get.GetStringOK()
+	if err != nil {
+		return "", err
+	}
+	if ok && !c.refresh(pttl) {
+		return v, nil
+	}
+
+	cl, leader := c.join(key)
+	for !leader {
+		if ok {
+			// someone else is already refreshing it
+			return v, nil
+		}
+		v, err := cl.wait(ctx)
+		if !leaderGone(ctx, err) {
+			return v, err
+		}
+		cl, leader = c.join(key)
+	}
+	func() {
+		defer c.finish(key, cl)
+		cl.val, cl.err = load(ctx, key)
+		if cl.err != nil {
+			return
+		}
+		c.store(ctx, map[string]*call{key: cl}, ttl)
+	}()
+	if ok && cl.err != nil {
+		// a failed early refresh, but the old value is still good
+		return v, nil
+	}
+	return cl.val, cl.err
+}
+
+// GetMulti returns the values of all `keys`, with a single MGET per shard.
+// The misses are loaded with a single call to `load`, and stored for `ttl`.
+// Keys which have no value are not in the returned map. Values which can't be
+// stored are returned all the same, see OptionStoreError.
+func (c *Cache) GetMulti(ctx context.Context, keys []string, ttl time.Duration, load BatchLoader) (map[string]string, error) {
+	res, missing, err := c.mget(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	var (
+		mine  []string
+		calls = map[string]*call{}
+		waits = map[string]*call{}
+	)
+	for _, k := range missing {
+		cl, leader := c.join(k)
+		if leader {
+			mine = append(mine, k)
+			calls[k] = cl
+		} else {
+			waits[k] = cl
+		}
+	}
+	if len(mine) > 0 {
+		func() {
+			defer func() {
+				for k, cl := range calls {
+					c.finish(k, cl)
+				}
+			}()
+			vs, err := load(ctx, mine)
+			found := map[string]*call{}
+			for k, cl := range calls {
+				if err != nil {
+					cl.err = err
+					continue
+				}
+				v, ok := vs[k]
+				if !ok {
+					cl.err = ErrNotFound
+					continue
+				}
+				cl.val, cl.err = v, nil
+				found[k] = cl
+			}
+			c.store(ctx, found, ttl)
+		}()
+		for k, cl := range calls {
+			waits[k] = cl
+		}
+	}
+
+	var again []string
+	for k, cl := range waits {
+		v, err := cl.wait(ctx)
+		switch {
+		case err == nil:
+			res[k] = v
+		case err == ErrNotFound:
+		case leaderGone(ctx, err):
+			again = append(again, k)
+		default:
+			return nil, err
+		}
+	}
+	if len(again) > 0 {
+		vs, err := c.GetMulti(ctx, again, ttl, load)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vs {
+			res[k] = v
+		}
+	}
+	return res, nil
+}
+
+// leaderGone is whether a load we waited for failed because the context of
+// the caller who did the load is done, while ours is not.
+func leaderGone(ctx context.Context, err error) bool {
+	return ctx.Err() == nil &&
+		(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// mget gets all keys, with an MGET per shard. It returns the found values and
+// the missing keys.
+func (c *Cache) mget(ctx context.Context, keys []string) (map[string]string, []string, error) {
+	var (
+		labels []string
+		groups = map[string][]string{}
+		seen   = map[string]bool{}
+	)
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		l := c.shr.Addr(k)
+		if _, ok := groups[l]; !ok {
+			labels = append(labels, l)
+		}
+		groups[l] = append(groups[l], k)
+	}
+	cmds := make([]*shredis.Cmd, len(labels))
+	for i, l := range labels {
+		cmds[i] = shredis.Build(groups[l][0], append([]string{"MGET"}, groups[l]...)...)
+	}
+	c.shr.ExecMode(ctx, shredis.ReconnectDefault, cmds...)
+
+	var (
+		res     = map[string]string{}
+		missing []string
+	)
+	for i, l := range labels {
+		vs, err := cmds[i].GetSlice()
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, k := range groups[l] {
+			if j >= len(vs) || vs[j] == nil {
+				missing = append(missing, k)
+				continue
+			}
+			v, ok := vs[j].(string)
+			if !ok {
+				missing = append(missing, k)
+				continue
+			}
+			res[k] = v
+		}
+	}
+	return res, missing, nil
+}
+
+// store SETs all values, in a single Exec. Failures go to the OptionStoreError
+// callback.
+func (c *Cache) store(ctx context.Context, calls map[string]*call, ttl time.Duration) {
+	if len(calls) == 0 {
+		return
+	}
+	var (
+		keys []string
+		cmds []*shredis.Cmd
+	)
+	for k, cl := range calls {
+		keys = append(keys, k)
+		cmds = append(cmds, shredis.BuildSetPx(k, cl.val, ttl))
+	}
+	c.shr.ExecMode(ctx, shredis.ReconnectDefault, cmds...)
+	for i, cmd := range cmds {
+		if _, err := cmd.Get(); err != nil && c.storeErr != nil {
+			c.storeErr(keys[i], err)
+		}
+	}
+}
+
+// refresh decides whether to refresh a key early, given its PTTL.
+func (c *Cache) refresh(pttl *shredis.Cmd) bool {
+	if pttl == nil {
+		return false
+	}
+	ms, err := pttl.GetInt64()
+	if err != nil || ms < 0 {
+		return false
+	}
+	left := time.Duration(ms) * time.Millisecond
+	if left >= c.early {
+		return false
+	}
+	return c.rand() >= float64(left)/float64(c.early)
+}
+
+// join returns the call for key, and whether this caller is the one who has to
+// load it.
+func (c *Cache) join(key string) (*call, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cl, ok := c.calls[key]; ok {
+		return cl, false
+	}
+	cl := &call{
+		done: make(chan struct{}),
+		err:  errPanic,
+	}
+	c.calls[key] = cl
+	return cl, true
+}
+
+func (c *Cache) finish(key string, cl *call) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+}
@@ -0,0 +1,381 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func setup(t *testing.T) (*miniredis.Miniredis, *miniredis.Miniredis, *shredis.Shred) {
+	mrs, shards := redistest.Miniredis(t, "shard1", "shard2")
+	return mrs[0], mrs[1], shredis.New(shards)
+}
+
+func TestGet(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	var (
+		ctx   = context.Background()
+		c     = New(shr)
+		loads int
+		load  = func(ctx context.Context, key string) (string, error) {
+			loads++
+			return "value of " + key, nil
+		}
+	)
+
+	for i := 0; i < 3; i++ {
+		v, err := c.Get(ctx, "foo", time.Minute, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := v, "value of foo"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+	if have, want := loads, 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	mr := mr1
+	if shr.Addr("foo") == "shard2" {
+		mr = mr2
+	}
+	if have, want := mr.TTL("foo"), time.Minute; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// expired
+	mr.FastForward(time.Minute)
+	if _, err := c.Get(ctx, "foo", time.Minute, load); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := loads, 2; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	// errors are not cached
+	broken := errors.New("broken")
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(ctx, "bar", time.Minute, func(ctx context.Context, key string) (string, error) {
+			loads++
+			return "", broken
+		})
+		if have, want := err, broken; have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+	if have, want := loads, 4; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestGetCoalesce(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	var (
+		ctx     = context.Background()
+		c       = New(shr)
+		loads   int32
+		release = make(chan struct{})
+		load    = func(ctx context.Context, key string) (string, error) {
+			atomic.AddInt32(&loads, 1)
+			<-release
+			return "slow", nil
+		}
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get(ctx, "foo", time.Minute, load)
+			if err != nil {
+				t.Error(err)
+			}
+			if have, want := v, "slow"; have != want {
+				t.Errorf("have %q, want %q", have, want)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if have, want := atomic.LoadInt32(&loads), int32(1); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestGetCoalesceCancel(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	var (
+		c       = New(shr)
+		loads   int32
+		started = make(chan struct{})
+		load    = func(ctx context.Context, key string) (string, error) {
+			if atomic.AddInt32(&loads, 1) == 1 {
+				close(started)
+				<-ctx.Done()
+				return "", ctx.Err()
+			}
+			return "loaded", nil
+		}
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, "foo", time.Minute, load)
+		leader <- err
+	}()
+	<-started
+
+	waiter := make(chan string, 1)
+	go func() {
+		v, err := c.Get(context.Background(), "foo", time.Minute, load)
+		if err != nil {
+			t.Error(err)
+		}
+		waiter <- v
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if have, want := <-leader, context.Canceled; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if have, want := <-waiter, "loaded"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have, want := atomic.LoadInt32(&loads), int32(2); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	var (
+		ctx   = context.Background()
+		c     = New(shr, OptionEarlyRefresh(10*time.Second))
+		loads int
+		load  = func(ctx context.Context, key string) (string, error) {
+			loads++
+			return fmt.Sprintf("v%d", loads), nil
+		}
+	)
+	c.rand = func() float64 { return 0.5 }
+	mr := mr1
+	if shr.Addr("foo") == "shard2" {
+		mr = mr2
+	}
+
+	if _, err := c.Get(ctx, "foo", time.Minute, load); err != nil {
+		t.Fatal(err)
+	}
+
+	// not in the window yet
+	mr.FastForward(45 * time.Second)
+	v, err := c.Get(ctx, "foo", time.Minute, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := v, "v1"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// in the window, but not close enough
+	mr.FastForward(4 * time.Second)
+	v, err = c.Get(ctx, "foo", time.Minute, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := v, "v1"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// 3s left, that's refreshed
+	mr.FastForward(8 * time.Second)
+	v, err = c.Get(ctx, "foo", time.Minute, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := v, "v2"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have, want := mr.TTL("foo"), time.Minute; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// a failed refresh gives the old value
+	mr.FastForward(55 * time.Second)
+	v, err = c.Get(ctx, "foo", time.Minute, func(ctx context.Context, key string) (string, error) {
+		return "", errors.New("broken")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := v, "v2"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	var (
+		ctx    = context.Background()
+		c      = New(shr)
+		keys   []string
+		loaded []string
+		load   = func(ctx context.Context, keys []string) (map[string]string, error) {
+			loaded = append(loaded, keys...)
+			res := map[string]string{}
+			for _, k := range keys {
+				if k == "item4" {
+					continue
+				}
+				res[k] = "loaded " + k
+			}
+			return res, nil
+		}
+	)
+	// "key" and "item" keys end up on different shards
+	for i := 0; i < 5; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i), fmt.Sprintf("item%d", i))
+	}
+	set := shredis.BuildSet("key0", "cached")
+	shr.Exec(set)
+	if _, err := set.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := c.GetMulti(ctx, append(keys, "key1"), time.Minute, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(vs), 9; have != want {
+		t.Fatalf("have %d, want %d: %v", have, want, vs)
+	}
+	if have, want := vs["key0"], "cached"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have, want := vs["item2"], "loaded item2"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	sort.Strings(loaded)
+	want := append([]string{}, keys[1:]...)
+	sort.Strings(want)
+	if have := loaded; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if len(mr1.Keys()) == 0 || len(mr2.Keys()) == 0 {
+		t.Errorf("keys not on both shards: %v %v", mr1.Keys(), mr2.Keys())
+	}
+
+	// now only the one which wasn't found is loaded again
+	loaded = nil
+	vs, err = c.GetMulti(ctx, keys, time.Minute, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(vs), 9; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+	if have, want := loaded, []string{"item4"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// Get() on a key the batch loader doesn't know
+	_, err = c.Get(ctx, "item4", time.Minute, func(ctx context.Context, key string) (string, error) {
+		return "", ErrNotFound
+	})
+	if have, want := err, ErrNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	var (
+		ctx    = context.Background()
+		failed []string
+		c      = New(shr, OptionStoreError(func(key string, err error) {
+			if err == nil {
+				t.Errorf("no error for %s", key)
+			}
+			failed = append(failed, key)
+		}))
+		loads int
+		load  = func(ctx context.Context, key string) (string, error) {
+			loads++
+			return "value of " + key, nil
+		}
+	)
+
+	// a TTL of 0 makes the SET fail
+	for i := 0; i < 2; i++ {
+		v, err := c.Get(ctx, "foo", 0, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := v, "value of foo"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+	if have, want := loads, 2; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+	if have, want := failed, []string{"foo", "foo"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	failed = nil
+	vs, err := c.GetMulti(ctx, []string{"key1", "item1"}, 0, func(ctx context.Context, keys []string) (map[string]string, error) {
+		res := map[string]string{}
+		for _, k := range keys {
+			res[k] = "loaded " + k
+		}
+		return res, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := vs, map[string]string{"key1": "loaded key1", "item1": "loaded item1"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	sort.Strings(failed)
+	if have, want := failed, []string{"item1", "key1"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,157 @@
+package shredis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Conn is a private connection to a single shard, for commands which need
+// connection state, such as WATCH/MULTI/EXEC. Get one with Shred.Conn(). Not
+// goroutine safe.
+type Conn struct {
+	dc   *dconn
+	pool *connPool
+	// near and slot are for dropping what the near cache has for our writes.
+	near *nearCache
+	slot int
+	// watching and multi are whether there is an open WATCH or MULTI.
+	watching, multi bool
+	// dirty is set after commands which change the connection for good
+	// (SELECT, CLIENT, ...). Those connections are not reused.
+	dirty bool
+}
+
+// Conn checks out a private connection to the shard of `key`. The connection
+// does its own AUTH. Close() gives it back. Open WATCHes and MULTIs are undone
+// on Close(), but connections which had commands such as SELECT or CLIENT
+// TRACKING are closed, not reused. See OptionPoolSize.
+func (s *Shred) Conn(ctx context.Context, key string) (*Conn, error) {
+	slot := s.ket.Slot(hashKey(key))
+	sh := s.shards[slot]
+	dc, err := sh.pool.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("shredis: %w", err)
+	}
+	return &Conn{
+		dc:   dc,
+		pool: sh.pool,
+		near: s.near,
+		slot: slot,
+	}, nil
+}
+
+// Exec executes commands, in a single pipeline. All commands go to the shard of
+// the connection, whatever their key. The returned error is only set for
+// connection problems, after which the connection can't be used anymore. The
+// commands also get that error.
+func (c *Conn) Exec(ctx context.Context, cmds ...*Cmd) error {
+	if c.dc == nil {
+		return fmt.Errorf("shredis: %w", ErrClosed)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	cmds = acquireAll(cmds)
+	defer releaseAll(cmds)
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	timeout := connTimeout
+	for _, cmd := range cmds {
+		if !cmd.blocking {
+			continue
+		}
+		if cmd.block == 0 {
+			timeout = 0
+			break
+		}
+		if t := cmd.block + connTimeout; t > timeout {
+			timeout = t
+		}
+	}
+
+	// before and after, since a MULTI only writes on its EXEC
+	c.near.dropWrites(c.slot, cmds...)
+	err := c.dc.doAll(ctx, cmds, timeout)
+	c.near.dropWrites(c.slot, cmds...)
+	for _, cmd := range cmds {
+		c.track(cmdName(cmd.payload))
+	}
+	if err != nil && c.pool.isClosed() {
+		err = ErrClosed
+		for _, cmd := range cmds {
+			if cmd.connErr {
+				cmd.setConnError(err)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("shredis: %w", err)
+	}
+	return nil
+}
+
+// track updates the connection state for a command.
+func (c *Conn) track(name string) {
+	switch name {
+	case "WATCH":
+		c.watching = true
+	case "UNWATCH":
+		c.watching = false
+	case "MULTI":
+		c.multi = true
+	case "EXEC", "DISCARD":
+		c.multi = false
+		c.watching = false
+	case "SELECT", "CLIENT", "HELLO", "AUTH", "RESET", "READONLY", "READWRITE",
+		"SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "MONITOR":
+		c.dirty = true
+	}
+}
+
+// Close gives the connection back. The Conn can't be used after this.
+func (c *Conn) Close() error {
+	dc := c.dc
+	if dc == nil {
+		return fmt.Errorf("shredis: %w", ErrClosed)
+	}
+	c.dc = nil
+
+	var reset *Cmd
+	switch {
+	case c.dirty:
+		dc.broken = true
+	case c.multi:
+		reset = Build("", "DISCARD")
+	case c.watching:
+		reset = Build("", "UNWATCH")
+	}
+	if reset != nil {
+		if err := dc.do(context.Background(), reset, connTimeout); err != nil || reset.err != nil {
+			dc.broken = true
+		}
+	}
+	c.pool.put(dc)
+	return nil
+}
+
+// cmdName gives the command name of a payload, in upper case.
+func cmdName(payload []byte) string {
+	// *<n>\r\n$<len>\r\n<name>\r\n
+	p := payload
+	for i := 0; i < 2; i++ {
+		j := bytes.IndexByte(p, '\n')
+		if j < 0 {
+			return ""
+		}
+		p = p[j+1:]
+	}
+	j := bytes.IndexByte(p, '\r')
+	if j < 0 {
+		return ""
+	}
+	return strings.ToUpper(string(p[:j]))
+}
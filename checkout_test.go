@@ -0,0 +1,143 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+func TestConnWatch(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("foo", "1")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+	ctx := context.Background()
+
+	c, err := shr.Conn(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := BuildGet("foo")
+	if err := c.Exec(ctx, Build("foo", "WATCH", "foo"), get); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := get.GetInt(); err != nil || v != 1 {
+		t.Fatalf("have %v %v, want 1", v, err)
+	}
+
+	// someone else changes the key
+	shr.Exec(BuildSet("foo", "5"))
+
+	exec := Build("foo", "EXEC")
+	if err := c.Exec(ctx, Build("foo", "MULTI"), BuildSet("foo", "2"), exec); err != nil {
+		t.Fatal(err)
+	}
+	// miniredis gives an empty array, redis a nil
+	if res, err := exec.GetSlice(); err != nil || len(res) != 0 {
+		t.Fatalf("have %v %v, want an aborted EXEC", res, err)
+	}
+	if have, _ := mr.Get("foo"); have != "5" {
+		t.Fatalf("have %q, want %q", have, "5")
+	}
+
+	// a WATCH which is still open is undone on Close
+	if err := c.Exec(ctx, Build("foo", "WATCH", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Exec(ctx, get); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v, want %v", err, ErrClosed)
+	}
+
+	// the connection is reused
+	c, err = shr.Conn(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shr.Exec(BuildSet("foo", "6"))
+	exec = Build("foo", "EXEC")
+	if err := c.Exec(ctx, Build("foo", "MULTI"), BuildSet("foo", "7"), exec); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := exec.GetSlice(); err != nil || len(res) != 1 {
+		t.Fatalf("have %v %v, want an EXEC", res, err)
+	}
+	c.Close()
+	if have, _ := mr.Get("foo"); have != "7" {
+		t.Fatalf("have %q, want %q", have, "7")
+	}
+}
+
+func TestConnSelect(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.RequireAuth("secret")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	}, OptionAuth("secret"))
+	defer shr.Close()
+	ctx := context.Background()
+
+	c, err := shr.Conn(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Exec(ctx, Build("foo", "SELECT", "2"), BuildSet("foo", "bar")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if have, want := len(shr.shards[0].pool.idle), 0; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	c, err = shr.Conn(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := BuildGet("foo")
+	if err := c.Exec(ctx, get); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := get.GetStringOK(); ok || err != nil {
+		t.Fatalf("have %v %v, want nothing", ok, err)
+	}
+	c.Close()
+	if have, want := len(shr.shards[0].pool.idle), 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	shr.Close()
+	if _, err := shr.Conn(ctx, "foo"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestCmdName(t *testing.T) {
+	for _, c := range []struct {
+		cmd  *Cmd
+		want string
+	}{
+		{Build("k", "get", "k"), "GET"},
+		{Build("k", "MULTI"), "MULTI"},
+		{&Cmd{}, ""},
+	} {
+		if have := cmdName(c.cmd.payload); have != c.want {
+			t.Errorf("have %q, want %q", have, c.want)
+		}
+	}
+}
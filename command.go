@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 var (
@@ -22,28 +23,134 @@ type Cmd struct {
 	payload []byte
 	res     interface{}
 	err     error
+	// retry is whether the command can be retried after a connection error.
+	retry bool
+	// connErr is whether err is a connection error.
+	connErr bool
+	// inFlight is 1 while an Exec() has the command. Atomic.
+	inFlight int32
+	// fields are the hash fields of a BuildHmgetStruct(), for Scan().
+	fields []string
+	// blocking is set for blocking commands, which can block for block (0 is
+	// forever).
+	blocking bool
+	block    time.Duration
+	// near is set for commands which the near cache can serve. nearKey is
+	// the redis key they read.
+	near    bool
+	nearKey string
+	// multi is set for MULTI, which turns off the near cache for its Exec().
+	multi bool
+	// buildErr is set for commands which could not be built. They are never
+	// executed, and always fail with it.
+	buildErr error
 }
 
 // Build makes a command which will be send to the shard for 'key'. All
 // redis commands work, but it's not advised to use commands which are stateful
 // ('SELECT'), involve multiple servers ('MGET', 'MGET', 'RENAME'), or are not
-// simple command->reply ('WATCH').
+// simple command->reply ('WATCH'). Blocking commands ('BLPOP') are fine, they
+// run on a connection of their own. See OptionPoolSize.
 func Build(key string, fields ...string) *Cmd {
-	return &Cmd{
+	c := &Cmd{
 		hash:    hashKey(key),
 		payload: buildCommand(fields, make([]byte, 0, 64)),
 		err:     ErrNotExecuted,
 	}
+	c.setKind(fields)
+	return c
+}
+
+// Command flags, for what Build() needs to know about a command.
+const (
+	flagReadOnly = 1 << iota
+	flagNear
+	flagBlocking
+	flagMulti
+)
+
+// commandFlags are the flags of all commands which have any, by upper case
+// name.
+var commandFlags = func() map[string]uint8 {
+	m := map[string]uint8{}
+	for c := range readOnly {
+		m[c] |= flagReadOnly
+	}
+	for c := range nearCacheable {
+		m[c] |= flagNear
+	}
+	for c := range blockingLast {
+		m[c] |= flagBlocking
+	}
+	for c := range blockingFirst {
+		m[c] |= flagBlocking
+	}
+	m["XREAD"] |= flagBlocking
+	m["XREADGROUP"] |= flagBlocking
+	m["MULTI"] |= flagMulti
+	return m
+}()
+
+// lookupFlags gives the flags of a command, in any case. It doesn't allocate.
+func lookupFlags(name string) uint8 {
+	if f, ok := commandFlags[name]; ok {
+		return f
+	}
+	var (
+		buf   [20]byte // room for the longest name with flags
+		lower bool
+	)
+	if len(name) > len(buf) {
+		return 0
+	}
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if 'a' <= b && b <= 'z' {
+			b -= 'a' - 'A'
+			lower = true
+		}
+		buf[i] = b
+	}
+	if !lower {
+		return 0
+	}
+	return commandFlags[string(buf[:len(name)])]
+}
+
+// setKind sets what the command is, for retries, blocking, and the near cache.
+// The slower checks are only done for the commands they're about.
+func (c *Cmd) setKind(fields []string) {
+	c.retry, c.blocking, c.block, c.near, c.nearKey = false, false, 0, false, ""
+	c.multi = false
+	if len(fields) == 0 {
+		return
+	}
+	f := lookupFlags(fields[0])
+	c.retry = f&flagReadOnly != 0
+	if f&flagBlocking != 0 {
+		c.block, c.blocking = blockTimeout(fields)
+	}
+	if f&flagNear != 0 && len(fields) > 1 {
+		c.near, c.nearKey = true, fields[1]
+	}
+	c.multi = f&flagMulti != 0
 }
 
 func (c *Cmd) set(res interface{}, err error) {
 	c.res = res
 	c.err = nil
+	c.connErr = false
 	if err != nil {
-		c.err = fmt.Errorf("shredis: %s", err)
+		c.err = fmt.Errorf("shredis: %w", err)
 	}
 }
 
+// setConnError is set() for connection problems.
+func (c *Cmd) setConnError(err error) {
+	c.set(nil, err)
+	c.connErr = err != ErrClosed
+}
+
 // Get returns redis' result.
 func (c *Cmd) Get() (interface{}, error) {
 	err := c.err
@@ -52,7 +159,7 @@ func (c *Cmd) Get() (interface{}, error) {
 }
 
 // GetString returns the value if it's a single string. If the key is not set
-// the returned string will be empty.
+// the returned string will be empty. See GetStringOK.
 func (c *Cmd) GetString() (string, error) {
 	err := c.err
 	c.err = ErrAlreadyGot
@@ -93,7 +200,7 @@ func (c *Cmd) GetStrings() ([]string, error) {
 
 // GetInt returns the value of Get() if it's either a int in REPL, or if it's a
 // string which can be converterd to an int. If the key is not set the value
-// will be 0.
+// will be 0. See GetIntOK.
 func (c *Cmd) GetInt() (int, error) {
 	err := c.err
 	c.err = ErrAlreadyGot
@@ -204,6 +311,198 @@ func (c *Cmd) GetMapStringInt() (map[string]int, error) {
 	return res, nil
 }
 
+// GetInt64 is GetInt(), for an int64.
+func (c *Cmd) GetInt64() (int64, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return 0, err
+	}
+	if c.res == nil {
+		return 0, nil
+	}
+	return resInt64(c.res)
+}
+
+// GetFloat64 returns the value if it's a float, such as from INCRBYFLOAT or
+// ZSCORE, or an int. If the key is not set the value will be 0.
+func (c *Cmd) GetFloat64() (float64, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return 0, err
+	}
+	if c.res == nil {
+		return 0, nil
+	}
+	return resFloat(c.res)
+}
+
+// GetBool returns the value as a bool. Ints are true if they are not 0 (EXISTS,
+// SISMEMBER, SETNX), "OK" is true (SET NX), and other strings are parsed with
+// strconv.ParseBool. If the key is not set the value will be false.
+func (c *Cmd) GetBool() (bool, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return false, err
+	}
+	switch k := c.res.(type) {
+	case nil:
+		return false, nil
+	case int:
+		return k != 0, nil
+	case string:
+		if k == "OK" {
+			return true, nil
+		}
+		return strconv.ParseBool(k)
+	default:
+		return false, fmt.Errorf("unexpected value. have %T, want int or string", c.res)
+	}
+}
+
+// GetInts returns the value if it's a slice of ints, or strings which can be
+// converted to ints. Elements which are not set (MGET) will be 0. If the key is
+// not set the returned slice will be empty.
+func (c *Cmd) GetInts() ([]int, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return nil, err
+	}
+	if c.res == nil {
+		return nil, nil
+	}
+	s, ok := c.res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected value. have %T, want []interface{}", c.res)
+	}
+	res := make([]int, len(s))
+	for i, v := range s {
+		if v == nil {
+			continue
+		}
+		n, err := resInt(v)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = n
+	}
+	return res, nil
+}
+
+// ScoredMember is a sorted set member with its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// GetScoredMembers returns the value of a ZRANGE (and friends) WITHSCORES, in
+// order. If the key is not set the returned slice will be empty.
+func (c *Cmd) GetScoredMembers() ([]ScoredMember, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return nil, err
+	}
+	if c.res == nil {
+		return nil, nil
+	}
+	s, ok := c.res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected value. have %T, want []interface{}", c.res)
+	}
+
+	res := make([]ScoredMember, 0, len(s)/2)
+	for len(s) > 1 {
+		m, err := resString(s[0])
+		if err != nil {
+			return nil, err
+		}
+		score, err := resFloat(s[1])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ScoredMember{Member: m, Score: score})
+		s = s[2:]
+	}
+	return res, nil
+}
+
+// GetFloatMap returns the value if it's a map[string]float64, such as from
+// ZRANGE WITHSCORES. If the key is not set the returned map will be empty.
+func (c *Cmd) GetFloatMap() (map[string]float64, error) {
+	ms, err := c.GetScoredMembers()
+	if err != nil || ms == nil {
+		return nil, err
+	}
+	res := make(map[string]float64, len(ms))
+	for _, m := range ms {
+		res[m.Member] = m.Score
+	}
+	return res, nil
+}
+
+// GetSlice returns the value if it's an array, for nested replies such as from
+// XRANGE or GEOSEARCH. Elements are strings, ints, nils, errors, or more
+// []interface{}. If the key is not set the returned slice will be empty.
+func (c *Cmd) GetSlice() ([]interface{}, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return nil, err
+	}
+	if c.res == nil {
+		return nil, nil
+	}
+	s, ok := c.res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected value. have %T, want []interface{}", c.res)
+	}
+	return s, nil
+}
+
+// The Get*OK() functions are the Get*() functions which also tell whether the
+// key was set. ok is false for a nil reply (and for errors), so a missing key
+// can be told apart from a key with an empty or zero value. Array replies have
+// no OK version, since redis replies with an empty array for missing keys.
+
+// GetStringOK is GetString(), with ok false if the key was not set.
+func (c *Cmd) GetStringOK() (string, bool, error) {
+	ok := c.res != nil
+	v, err := c.GetString()
+	return v, ok && err == nil, err
+}
+
+// GetIntOK is GetInt(), with ok false if the key was not set.
+func (c *Cmd) GetIntOK() (int, bool, error) {
+	ok := c.res != nil
+	v, err := c.GetInt()
+	return v, ok && err == nil, err
+}
+
+// GetInt64OK is GetInt64(), with ok false if the key was not set.
+func (c *Cmd) GetInt64OK() (int64, bool, error) {
+	ok := c.res != nil
+	v, err := c.GetInt64()
+	return v, ok && err == nil, err
+}
+
+// GetFloat64OK is GetFloat64(), with ok false if the key was not set.
+func (c *Cmd) GetFloat64OK() (float64, bool, error) {
+	ok := c.res != nil
+	v, err := c.GetFloat64()
+	return v, ok && err == nil, err
+}
+
+// GetBoolOK is GetBool(), with ok false if the key was not set.
+func (c *Cmd) GetBoolOK() (bool, bool, error) {
+	ok := c.res != nil
+	v, err := c.GetBool()
+	return v, ok && err == nil, err
+}
+
 func resString(x interface{}) (string, error) {
 	switch k := x.(type) {
 	case string:
@@ -224,6 +523,28 @@ func resInt(x interface{}) (int, error) {
 	}
 }
 
+func resInt64(x interface{}) (int64, error) {
+	switch k := x.(type) {
+	case int:
+		return int64(k), nil
+	case string:
+		return strconv.ParseInt(k, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected value. have %T, want int or string", x)
+	}
+}
+
+func resFloat(x interface{}) (float64, error) {
+	switch k := x.(type) {
+	case int:
+		return float64(k), nil
+	case string:
+		return strconv.ParseFloat(k, 64)
+	default:
+		return 0, fmt.Errorf("unexpected value. have %T, want int or string", x)
+	}
+}
+
 func buildCommand(fields []string, b []byte) []byte {
 	b = append(b, '*')
 	b = strconv.AppendInt(b, int64(len(fields)), 10)
@@ -2,6 +2,7 @@ package shredis
 
 import (
 	"bytes"
+	"math"
 	"reflect"
 	"testing"
 )
@@ -321,3 +322,329 @@ func TestCmdErr(t *testing.T) {
 		t.Errorf("have: %q, want: %q", err, ErrAlreadyGot)
 	}
 }
+
+func TestGetInt64(t *testing.T) {
+	for _, c := range []struct {
+		have *Cmd
+		err  string
+		want int64
+	}{
+		{
+			have: &Cmd{res: "9223372036854775807"},
+			want: 9223372036854775807,
+		},
+		{
+			have: &Cmd{res: 12},
+			want: 12,
+		},
+		{
+			have: &Cmd{res: "1.5"},
+			err:  "strconv.ParseInt: parsing \"1.5\": invalid syntax",
+		},
+		{
+			have: &Cmd{res: []interface{}{}},
+			err:  "unexpected value. have []interface {}, want int or string",
+		},
+		{
+			have: &Cmd{res: nil},
+			want: 0,
+		},
+	} {
+		s, err := c.have.GetInt64()
+		var haveerr string
+		if err != nil {
+			haveerr = err.Error()
+		}
+		if have, want := haveerr, c.err; have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+		if have, want := s, c.want; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+}
+
+func TestGetFloat64(t *testing.T) {
+	for _, c := range []struct {
+		have *Cmd
+		err  string
+		want float64
+	}{
+		{
+			have: &Cmd{res: "3.14"},
+			want: 3.14,
+		},
+		{
+			have: &Cmd{res: 12},
+			want: 12,
+		},
+		{
+			have: &Cmd{res: "a string"},
+			err:  "strconv.ParseFloat: parsing \"a string\": invalid syntax",
+		},
+		{
+			have: &Cmd{res: nil},
+			want: 0,
+		},
+	} {
+		s, err := c.have.GetFloat64()
+		var haveerr string
+		if err != nil {
+			haveerr = err.Error()
+		}
+		if have, want := haveerr, c.err; have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+		if have, want := s, c.want; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	for _, c := range []struct {
+		have *Cmd
+		err  string
+		want bool
+	}{
+		{
+			have: &Cmd{res: 1},
+			want: true,
+		},
+		{
+			have: &Cmd{res: 0},
+			want: false,
+		},
+		{
+			have: &Cmd{res: "OK"},
+			want: true,
+		},
+		{
+			have: &Cmd{res: "true"},
+			want: true,
+		},
+		{
+			have: &Cmd{res: "a string"},
+			err:  "strconv.ParseBool: parsing \"a string\": invalid syntax",
+		},
+		{
+			have: &Cmd{res: nil},
+			want: false,
+		},
+	} {
+		s, err := c.have.GetBool()
+		var haveerr string
+		if err != nil {
+			haveerr = err.Error()
+		}
+		if have, want := haveerr, c.err; have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+		if have, want := s, c.want; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+}
+
+func TestGetInts(t *testing.T) {
+	for _, c := range []struct {
+		have *Cmd
+		err  string
+		want []int
+	}{
+		{
+			have: &Cmd{res: []interface{}{1, "2", nil}},
+			want: []int{1, 2, 0},
+		},
+		{
+			have: &Cmd{res: []interface{}{1, []interface{}{}}},
+			err:  "unexpected value. have []interface {}, want int or string",
+		},
+		{
+			have: &Cmd{res: 12},
+			err:  "unexpected value. have int, want []interface{}",
+		},
+		{
+			have: &Cmd{res: nil},
+		},
+	} {
+		s, err := c.have.GetInts()
+		var haveerr string
+		if err != nil {
+			haveerr = err.Error()
+		}
+		if have, want := haveerr, c.err; have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+		if have, want := s, c.want; !reflect.DeepEqual(have, want) {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+}
+
+func TestGetScoredMembers(t *testing.T) {
+	for _, c := range []struct {
+		have *Cmd
+		err  string
+		want []ScoredMember
+	}{
+		{
+			have: &Cmd{res: []interface{}{"one", "1", "two", "2.5", "three", "inf"}},
+			want: []ScoredMember{
+				{"one", 1},
+				{"two", 2.5},
+				{"three", math.Inf(1)},
+			},
+		},
+		{
+			have: &Cmd{res: []interface{}{"one", "many"}},
+			err:  "strconv.ParseFloat: parsing \"many\": invalid syntax",
+		},
+		{
+			have: &Cmd{res: "a string"},
+			err:  "unexpected value. have string, want []interface{}",
+		},
+		{
+			have: &Cmd{res: nil},
+		},
+	} {
+		s, err := c.have.GetScoredMembers()
+		var haveerr string
+		if err != nil {
+			haveerr = err.Error()
+		}
+		if have, want := haveerr, c.err; have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+		if have, want := s, c.want; !reflect.DeepEqual(have, want) {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+
+	m, err := (&Cmd{res: []interface{}{"one", "1", "two", "2"}}).GetFloatMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := m, map[string]float64{"one": 1, "two": 2}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestGetSlice(t *testing.T) {
+	res := []interface{}{
+		[]interface{}{"1-0", []interface{}{"f", "v"}},
+		nil,
+		12,
+	}
+	s, err := (&Cmd{res: res}).GetSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := s, res; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if _, err := (&Cmd{res: 12}).GetSlice(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestGetOK(t *testing.T) {
+	type res struct {
+		v  interface{}
+		ok bool
+	}
+	for _, c := range []struct {
+		cmd  *Cmd
+		get  func(*Cmd) (interface{}, bool, error)
+		want res
+	}{
+		{
+			cmd:  &Cmd{res: ""},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetStringOK() },
+			want: res{"", true},
+		},
+		{
+			cmd:  &Cmd{res: nil},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetStringOK() },
+			want: res{"", false},
+		},
+		{
+			cmd:  &Cmd{res: "0"},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetIntOK() },
+			want: res{0, true},
+		},
+		{
+			cmd:  &Cmd{res: nil},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetIntOK() },
+			want: res{0, false},
+		},
+		{
+			cmd:  &Cmd{res: 0},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetInt64OK() },
+			want: res{int64(0), true},
+		},
+		{
+			cmd:  &Cmd{res: nil},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetInt64OK() },
+			want: res{int64(0), false},
+		},
+		{
+			cmd:  &Cmd{res: "0.0"},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetFloat64OK() },
+			want: res{0.0, true},
+		},
+		{
+			cmd:  &Cmd{res: nil},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetFloat64OK() },
+			want: res{0.0, false},
+		},
+		{
+			cmd:  &Cmd{res: "OK"},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetBoolOK() },
+			want: res{true, true},
+		},
+		{
+			cmd:  &Cmd{res: nil},
+			get:  func(c *Cmd) (interface{}, bool, error) { return c.GetBoolOK() },
+			want: res{false, false},
+		},
+	} {
+		v, ok, err := c.get(c.cmd)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if have, want := (res{v, ok}), c.want; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+
+	c := &Cmd{res: "foo", err: ErrNotExecuted}
+	if _, ok, err := c.GetStringOK(); ok || err != ErrNotExecuted {
+		t.Errorf("have: %v %v, want: false %v", ok, err, ErrNotExecuted)
+	}
+}
+
+func TestLookupFlags(t *testing.T) {
+	for name, want := range map[string]uint8{
+		"GET":                   flagReadOnly | flagNear,
+		"get":                   flagReadOnly | flagNear,
+		"Ttl":                   flagReadOnly,
+		"HGetAll":               flagReadOnly | flagNear,
+		"INCR":                  0,
+		"MULTI":                 flagMulti,
+		"blpop":                 flagBlocking,
+		"XREADGROUP":            flagBlocking,
+		"SET":                   0,
+		"set":                   0,
+		"":                      0,
+		"averyveryverylongname": 0,
+	} {
+		if have := lookupFlags(name); have != want {
+			t.Errorf("%q: have %b, want %b", name, have, want)
+		}
+	}
+	if n := testing.AllocsPerRun(100, func() { lookupFlags("zrevrangebyscore") }); n != 0 {
+		t.Errorf("have %v allocs, want 0", n)
+	}
+}
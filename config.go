@@ -0,0 +1,109 @@
+package shredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Config is the configuration for NewShred.
+type Config struct {
+	// Shards is a map with shardname:address.
+	Shards map[string]string
+	// Weights is an optional map with shardname:weight. Shards not in here
+	// have weight 1.
+	Weights map[string]int
+	Options []Option
+}
+
+// validate checks the config, and the options already applied to s.
+func (s *Shred) validate(cfg Config) error {
+	if len(cfg.Shards) == 0 {
+		return fmt.Errorf("shredis: no shards configured")
+	}
+
+	addrs := map[string]string{}
+	for l, h := range cfg.Shards {
+		if l == "" {
+			return fmt.Errorf("shredis: empty shard name for %q", h)
+		}
+		if err := validateAddr(h); err != nil {
+			return fmt.Errorf("shredis: shard %s: %s", l, err)
+		}
+		if other, ok := addrs[h]; ok {
+			return fmt.Errorf("shredis: shards %s and %s have the same address: %s", other, l, h)
+		}
+		addrs[h] = l
+	}
+	for l, w := range cfg.Weights {
+		if _, ok := cfg.Shards[l]; !ok {
+			return fmt.Errorf("shredis: weight for unknown shard: %s", l)
+		}
+		if w < 1 {
+			return fmt.Errorf("shredis: shard %s: invalid weight: %d", l, w)
+		}
+	}
+
+	if s.backoffMin <= 0 || s.backoffMax < s.backoffMin {
+		return fmt.Errorf("shredis: invalid backoff: %s - %s", s.backoffMin, s.backoffMax)
+	}
+	if s.queueSize < 1 {
+		return fmt.Errorf("shredis: invalid reconnect queue size: %d", s.queueSize)
+	}
+	if s.retries < 0 {
+		return fmt.Errorf("shredis: invalid number of retries: %d", s.retries)
+	}
+	if s.queueDepth < 0 {
+		return fmt.Errorf("shredis: invalid queue depth: %d", s.queueDepth)
+	}
+	if s.overflow == OverflowTimeout && s.overflowTimeout <= 0 {
+		return fmt.Errorf("shredis: invalid overflow timeout: %s", s.overflowTimeout)
+	}
+	if s.maxCmds < 0 || s.maxBytes < 0 {
+		return fmt.Errorf("shredis: invalid batch limits: %d commands, %d bytes", s.maxCmds, s.maxBytes)
+	}
+	if s.poolSize < 0 {
+		return fmt.Errorf("shredis: invalid pool size: %d", s.poolSize)
+	}
+	if nc := s.nearCache; nc != nil {
+		if nc.MaxEntries < 0 || nc.MaxBytes < 0 || nc.MaxEntries == 0 && nc.MaxBytes == 0 {
+			return fmt.Errorf("shredis: invalid near cache limits: %d entries, %d bytes", nc.MaxEntries, nc.MaxBytes)
+		}
+	}
+	if s.healthCheck < 0 {
+		return fmt.Errorf("shredis: invalid health check interval: %s", s.healthCheck)
+	}
+	if b := s.breaker; b != nil {
+		if b.ErrorRate <= 0 || b.ErrorRate > 1 {
+			return fmt.Errorf("shredis: invalid breaker error rate: %g", b.ErrorRate)
+		}
+		if b.MinRequests < 1 || b.Window <= 0 || b.Cooldown <= 0 {
+			return fmt.Errorf("shredis: invalid breaker config: %+v", *b)
+		}
+	}
+	if s.preconnect {
+		if s.quorum < 0 || s.quorum > len(cfg.Shards) {
+			return fmt.Errorf("shredis: invalid preconnect quorum: %d with %d shards", s.quorum, len(cfg.Shards))
+		}
+		if s.preTimeout <= 0 {
+			return fmt.Errorf("shredis: invalid preconnect timeout: %s", s.preTimeout)
+		}
+	}
+	return nil
+}
+
+// validateAddr checks for a "host:port" address.
+func validateAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in address %q", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port in address %q", addr)
+	}
+	return nil
+}
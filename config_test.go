@@ -0,0 +1,142 @@
+package shredis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	for i, c := range []struct {
+		cfg Config
+		err string
+	}{
+		{
+			cfg: Config{},
+			err: "no shards configured",
+		},
+		{
+			cfg: Config{
+				Shards: map[string]string{"": "localhost:6379"},
+			},
+			err: "empty shard name",
+		},
+		{
+			cfg: Config{
+				Shards: map[string]string{"shard0": "localhost"},
+			},
+			err: "missing port in address",
+		},
+		{
+			cfg: Config{
+				Shards: map[string]string{"shard0": ":6379"},
+			},
+			err: "missing host in address",
+		},
+		{
+			cfg: Config{
+				Shards: map[string]string{"shard0": "localhost:999999"},
+			},
+			err: "invalid port in address",
+		},
+		{
+			cfg: Config{
+				Shards: map[string]string{
+					"shard0": "localhost:6379",
+					"shard1": "localhost:6379",
+				},
+			},
+			err: "have the same address",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Weights: map[string]int{"shard0": 0},
+			},
+			err: "invalid weight",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Weights: map[string]int{"shard1": 1},
+			},
+			err: "weight for unknown shard",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Options: []Option{OptionBackoff(time.Second, time.Millisecond)},
+			},
+			err: "invalid backoff",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Options: []Option{OptionReconnectQueue(0)},
+			},
+			err: "invalid reconnect queue size",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Options: []Option{OptionPoolSize(-1)},
+			},
+			err: "invalid pool size",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Options: []Option{OptionNearCache(NearCacheConfig{})},
+			},
+			err: "invalid near cache limits",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Options: []Option{OptionPreconnect(2, time.Second)},
+			},
+			err: "invalid preconnect quorum",
+		},
+		{
+			cfg: Config{
+				Shards:  map[string]string{"shard0": "localhost:6379"},
+				Options: []Option{OptionPreconnect(1, 0)},
+			},
+			err: "invalid preconnect timeout",
+		},
+	} {
+		_, err := NewShred(c.cfg)
+		if err == nil {
+			t.Errorf("%d: expected an error", i)
+			continue
+		}
+		if have, want := err.Error(), c.err; !strings.Contains(have, want) {
+			t.Errorf("%d: have %q, want %q in there", i, have, want)
+		}
+	}
+}
+
+func TestConfigWeights(t *testing.T) {
+	shr, err := NewShred(Config{
+		Shards: map[string]string{
+			"shard0": "localhost:6379",
+			"shard1": "localhost:6380",
+		},
+		Weights: map[string]int{"shard1": 100},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer shr.Close()
+
+	n := 0
+	for i := 0; i < 100; i++ {
+		if shr.Addr(fmt.Sprintf("key%d", i)) == "shard1" {
+			n++
+		}
+	}
+	if n < 90 {
+		t.Fatalf("have %d keys on shard1, want most of them", n)
+	}
+}
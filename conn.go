@@ -2,14 +2,43 @@ package shredis
 
 import (
 	"bufio"
+	"context"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
+// doner is told when an action is done. That's a *sync.WaitGroup, or a batch
+// for async Exec()s.
+type doner interface {
+	Done()
+}
+
 type action struct {
 	cmds []*Cmd
-	wg   *sync.WaitGroup
+	wg   doner
+	// queue is whether the action can wait for a reconnect, for as long as
+	// ctx allows. ctx can be nil if queue isn't set.
+	queue bool
+	ctx   context.Context
+	// probe is set for the probe request of a half-open breaker.
+	probe bool
+}
+
+// onConnectError gives the error of a reply to an on connect command. Error
+// replies (a wrong password) fail the handshake, except for an AUTH to a
+// server which has no password: the connection works all the same.
+func onConnectError(res interface{}) error {
+	err, ok := res.(error)
+	if !ok {
+		return nil
+	}
+	if msg := err.Error(); strings.Contains(msg, "no password is set") ||
+		strings.Contains(msg, "without any password configured") {
+		return nil
+	}
+	return err
 }
 
 func (a action) done() {
@@ -23,46 +52,131 @@ func (a action) doneError(err error) {
 	a.done()
 }
 
+// doneConnError is doneError for connection problems.
+func (a action) doneConnError(err error) {
+	for _, cmd := range a.cmds {
+		cmd.setConnError(err)
+	}
+	a.done()
+}
+
 type conn chan action
 
-func newConn() conn {
-	return make(conn, 5)
+func newConn(depth int) conn {
+	return make(conn, depth)
 }
 
 func (c conn) close() {
 	close(c)
 }
 
-func (c conn) exec(a action) {
-	c <- a
+// connOpts are the settings for handle.
+type connOpts struct {
+	addr, label string
+	// onConnect are commands which will be executed on connect. Used for
+	// authentication.
+	onConnect []*Cmd
+	log       LogCB
+	events    EventCB
+	// backoff is how long to wait after connection problems.
+	backoff *backoff
+	// queueSize is the max number of commands held during a reconnect.
+	queueSize int
+	// healthCheck is after how much idle time a PING is sent. 0 to disable.
+	healthCheck time.Duration
+	status      *shardStatus
+	// abort is closed when Shutdown() gives up waiting.
+	abort   chan struct{}
+	breaker *breaker
+	// maxCmds and maxBytes limit a single write/read round. 0 is no limit.
+	maxCmds, maxBytes int
+	// near is the near cache, if there is one. slot is our shard.
+	near *nearCache
+	slot int
 }
 
-// handle deals with all actions written to conn. onConnect are commands which
-// will be executed on connect. Used for authentication.
-func (c conn) handle(addr, label string, onConnect []*Cmd, log LogCB) {
-	// wait runs when there is a connection problem. We don't want to
-	// queue requests, just error them right away.
+// handle deals with all actions written to conn.
+func (c conn) handle(o connOpts) {
+	var (
+		addr, label = o.addr, o.label
+		b           = o.backoff
+	)
+	event := func(t EventType, err error) {
+		e := Event{
+			Type:  t,
+			Label: label,
+			Addr:  addr,
+			Err:   err,
+			Time:  time.Now(),
+		}
+		o.status.event(e)
+		o.events(e)
+	}
+	defer event(EventClosed, nil)
+
+	// held are the actions which wait for the connection to come back. nheld
+	// is the number of commands in them.
+	var (
+		held  []action
+		nheld int
+	)
+	// expire fails all held actions whose context is done.
+	expire := func() {
+		var keep []action
+		nheld = 0
+		for _, a := range held {
+			if err := a.ctx.Err(); err != nil {
+				a.doneError(err)
+				o.breaker.record(a.probe, false)
+				continue
+			}
+			keep = append(keep, a)
+			nheld += len(a.cmds)
+		}
+		held = keep
+	}
+
+	// wait runs when there is a connection problem. By default we don't want
+	// to queue requests, just error them right away. Actions which asked for
+	// it are held, as long as there is room.
 	// The returned bool is whether things are still ok.
 	wait := func(err error, t time.Duration) bool {
+		expire()
 		timeout := time.After(t)
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
 		for {
 			select {
 			case <-timeout:
 				return true
+			case <-tick.C:
+				expire()
 			case act, ok := <-c:
 				if !ok {
+					for _, a := range held {
+						a.doneError(ErrClosed)
+					}
+					held, nheld = nil, 0
 					return false
 				}
-				act.doneError(err)
+				if !act.queue || nheld+len(act.cmds) > o.queueSize {
+					act.doneConnError(err)
+					o.breaker.record(act.probe, false)
+					continue
+				}
+				held = append(held, act)
+				nheld += len(act.cmds)
 			}
 		}
 	}
 
 loop:
 	for {
+		event(EventDial, nil)
 		conn, err := net.DialTimeout("tcp", addr, connTimeout)
 		if err != nil {
-			if !wait(err, 50*time.Millisecond) {
+			event(EventDialFailed, err)
+			if !wait(err, b.next()) {
 				break
 			}
 			continue
@@ -73,91 +187,219 @@ loop:
 			w = bufio.NewWriter(conn)
 		)
 
-		for _, cmd := range onConnect {
+		for _, cmd := range o.onConnect {
 			conn.SetDeadline(time.Now().Add(connTimeout))
 			if _, err := conn.Write(cmd.payload); err != nil {
 				conn.Close()
-				if !wait(err, 50*time.Millisecond) {
+				event(EventHandshakeFailed, err)
+				if !wait(err, b.next()) {
+					break loop
+				}
+				continue loop
+			}
+			res, err := r.Next()
+			if err == nil {
+				err = onConnectError(res)
+			}
+			if err != nil {
+				conn.Close()
+				event(EventHandshakeFailed, err)
+				if !wait(err, b.next()) {
 					break loop
 				}
 				continue loop
 			}
-			if _, err := r.Next(); err != nil {
-				// AUTH errors won't be flagged.
+		}
+
+		if o.near != nil {
+			if err := o.near.handshake(conn, r, o.slot); err != nil {
 				conn.Close()
-				if !wait(err, 50*time.Millisecond) {
+				event(EventHandshakeFailed, err)
+				if !wait(err, b.next()) {
 					break loop
 				}
 				continue loop
 			}
 		}
 
-		if err := loopConnection(c, r, w, conn, label, log); err == nil {
+		b.reset()
+		event(EventConnected, nil)
+		stop := make(chan struct{})
+		go func() {
+			// breaks off any read or write
+			select {
+			case <-o.abort:
+				conn.Close()
+			case <-stop:
+			}
+		}()
+		err = loopConnection(c, held, r, w, conn, o)
+		close(stop)
+		held, nheld = nil, 0
+		conn.Close()
+		if o.near != nil {
+			// tracking is gone with the connection
+			o.near.clear(o.slot)
+		}
+		if err == nil {
 			// graceful shutdown
-			conn.Close()
 			break
 		}
-		conn.Close()
+		event(EventDisconnected, err)
+		if aborted(o.abort) {
+			for a := range c {
+				a.doneError(ErrClosed)
+			}
+			break
+		}
 	}
 }
 
 // loopConnection will keep writing commands to the server until either `c` is
-// closed or until we get any kind of error.
+// closed or until we get any kind of error. `held` are actions which were
+// waiting for this connection, they go first. If the connection is idle for
+// long enough it sends a PING.
 func loopConnection(
 	c conn,
+	held []action,
 	r *replyReader,
 	w *bufio.Writer,
 	tcpconn net.Conn,
-	label string,
-	log LogCB,
+	o connOpts,
 ) error {
-	var outstanding []action
+	var (
+		outstanding []action
+		ping        *Cmd
+		label, log  = o.label, o.log
+	)
+	// fail gives the error for the outstanding commands.
+	fail := func(err error) error {
+		if aborted(o.abort) {
+			return ErrClosed
+		}
+		return err
+	}
+	// failFrom fails all outstanding commands, starting with
+	// outstanding[ai].cmds[ci].
+	failFrom := func(ai, ci int, err error) {
+		a := outstanding[ai]
+		for _, c := range a.cmds[ci:] {
+			c.setConnError(err)
+		}
+		a.done()
+		for _, b := range outstanding[ai+1:] {
+			b.doneConnError(err)
+		}
+		if ping == nil {
+			for _, b := range outstanding[ai:] {
+				o.breaker.record(b.probe, false)
+			}
+		}
+	}
 
 	for {
 		outstanding = outstanding[:0]
-		// read at least a single action, possibly more.
-		a, ok := <-c
-		start := time.Now()
-	loop:
-		for {
-			if !ok {
-				// graceful shutdown
-				return nil
-			}
-			for _, cmd := range a.cmds {
-				w.Write(cmd.payload)
+		for _, a := range held {
+			if err := a.ctx.Err(); err != nil {
+				a.doneError(err)
+				o.breaker.record(a.probe, false)
+				continue
 			}
 			outstanding = append(outstanding, a)
+		}
+		held = nil
+		ping = nil
+		if len(outstanding) == 0 {
+			var idle <-chan time.Time
+			if o.healthCheck > 0 {
+				idle = time.After(o.healthCheck)
+			}
+			// read at least a single action, possibly more.
+			select {
+			case a, ok := <-c:
+				if !ok {
+					// graceful shutdown
+					return nil
+				}
+				outstanding = append(outstanding, a)
+			case <-idle:
+				ping = Build("", "PING")
+				wg := &sync.WaitGroup{}
+				wg.Add(1)
+				outstanding = append(outstanding, action{
+					cmds: []*Cmd{ping},
+					wg:   wg,
+				})
+			}
+		}
+		start := time.Now()
+	loop:
+		for ping == nil {
 			// see if there are more commands waiting
 			select {
-			case a, ok = <-c:
-				// go again
+			case a, ok := <-c:
+				if !ok {
+					// closed, we'll see that again in the next round.
+					break loop
+				}
+				outstanding = append(outstanding, a)
 			default:
 				break loop
 			}
 		}
 
-		tcpconn.SetDeadline(time.Now().Add(connTimeout))
-		if err := w.Flush(); err != nil {
-			for _, a := range outstanding {
-				a.doneError(err)
+		// Write and read in rounds of at most o.maxCmds commands and
+		// o.maxBytes bytes. Without limits that's a single round.
+		// outstanding[ai].cmds[ci] is the next command to write.
+		for ai, ci := 0, 0; ai < len(outstanding); {
+			var (
+				roundStart = time.Now()
+				ri, rj     = ai, ci // next reply to read
+				n, size    int
+			)
+			for ai < len(outstanding) {
+				cmd := outstanding[ai].cmds[ci]
+				if n > 0 && (o.maxCmds > 0 && n >= o.maxCmds ||
+					o.maxBytes > 0 && size+len(cmd.payload) > o.maxBytes) {
+					break
+				}
+				w.Write(cmd.payload)
+				n++
+				size += len(cmd.payload)
+				if ci++; ci == len(outstanding[ai].cmds) {
+					ai++
+					ci = 0
+				}
+			}
+			// number of actions with commands in this round
+			batchSize := ai - ri
+			if ci > 0 {
+				batchSize++
+			}
+
+			tcpconn.SetDeadline(time.Now().Add(connTimeout))
+			// the log comes before the last done(), so it's there when
+			// Exec() returns.
+			if err := w.Flush(); err != nil {
+				err = fail(err)
+				if ping == nil {
+					log(label, batchSize, 0, err)
+				}
+				failFrom(ri, rj, err)
+				return err
 			}
-			log(label, len(outstanding), 0, err)
-			return err
-		}
 
-		for i, a := range outstanding {
-			for j, cmd := range a.cmds {
+			logged := false
+
+			for ; n > 0; n-- {
+				a := outstanding[ri]
 				res, err := r.Next()
 				if err != nil {
-					for _, c := range a.cmds[j:] {
-						c.set(nil, err)
-					}
-					a.done()
-					for _, b := range outstanding[i+1:] {
-						b.doneError(err)
+					err = fail(err)
+					if ping == nil {
+						log(label, batchSize, 0, err)
 					}
-					log(label, len(outstanding), 0, err)
+					failFrom(ri, rj, err)
 					return err
 				}
 
@@ -167,10 +409,45 @@ func loopConnection(
 					err = perr
 					res = nil
 				}
-				cmd.set(res, err)
+				a.cmds[rj].set(res, err)
+				if rj++; rj == len(a.cmds) {
+					if n == 1 && ping == nil {
+						log(label, batchSize, time.Since(roundStart), nil)
+						logged = true
+					}
+					a.done()
+					if ping == nil {
+						o.breaker.record(a.probe, true)
+					}
+					ri++
+					rj = 0
+				}
+			}
+			if ping == nil && !logged {
+				log(label, batchSize, time.Since(roundStart), nil)
+			}
+		}
+
+		if ping != nil {
+			rtt := time.Since(start)
+			if _, err := ping.Get(); err != nil {
+				// things like LOADING, or a failed AUTH.
+				o.status.fail(err)
+				continue
 			}
-			a.done()
+			o.status.success(rtt)
+			continue
 		}
-		log(label, len(outstanding), time.Since(start), nil)
+		o.status.success(0)
+	}
+}
+
+// aborted is whether abort is closed.
+func aborted(abort chan struct{}) bool {
+	select {
+	case <-abort:
+		return true
+	default:
+		return false
 	}
 }
@@ -0,0 +1,161 @@
+package shredis
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// dconn is a connection which is not shared with other goroutines, for
+// commands which block or which change the state of the connection. Not
+// goroutine safe.
+type dconn struct {
+	addr string
+	c    net.Conn
+	r    *replyReader
+	w    *bufio.Writer
+	// broken is set after a connection error. The connection can't be used
+	// anymore after that.
+	broken bool
+}
+
+// shardFor gives the shard for a key.
+func (s *Shred) shardFor(key string) shard {
+	return s.shards[s.ket.Slot(hashKey(key))]
+}
+
+// dial makes a new dedicated connection, and does the on connect commands
+// (AUTH).
+func (s *Shred) dial(ctx context.Context, addr string) (*dconn, error) {
+	d := net.Dialer{Timeout: connTimeout}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	dc := &dconn{
+		addr: addr,
+		c:    c,
+		r:    newReplyReader(c),
+		w:    bufio.NewWriter(c),
+	}
+	for _, cmd := range s.onConnect {
+		res, err := dc.roundtrip(ctx, cmd.payload, connTimeout)
+		if err == nil {
+			err = onConnectError(res)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return dc, nil
+}
+
+// do executes a single command. See doAll.
+func (dc *dconn) do(ctx context.Context, cmd *Cmd, timeout time.Duration) error {
+	return dc.doAll(ctx, []*Cmd{cmd}, timeout)
+}
+
+// doAll executes commands in a single pipeline. The commands get the results,
+// but the returned error is only set for connection errors, after which the
+// connection is broken. A timeout of 0 is no timeout.
+func (dc *dconn) doAll(ctx context.Context, cmds []*Cmd, timeout time.Duration) error {
+	i := 0
+	err := dc.run(ctx, timeout, func() error {
+		for _, c := range cmds {
+			if _, err := dc.w.Write(c.payload); err != nil {
+				return err
+			}
+		}
+		if err := dc.w.Flush(); err != nil {
+			return err
+		}
+		for ; i < len(cmds); i++ {
+			res, err := dc.r.Next()
+			if err != nil {
+				return err
+			}
+			// 'ERR' replies.
+			if perr, ok := res.(error); ok {
+				cmds[i].set(nil, perr)
+				continue
+			}
+			cmds[i].set(res, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, c := range cmds[i:] {
+			c.setConnError(err)
+		}
+	}
+	return err
+}
+
+// roundtrip writes a payload and reads the reply.
+func (dc *dconn) roundtrip(ctx context.Context, payload []byte, timeout time.Duration) (interface{}, error) {
+	var res interface{}
+	err := dc.run(ctx, timeout, func() error {
+		if _, err := dc.w.Write(payload); err != nil {
+			return err
+		}
+		if err := dc.w.Flush(); err != nil {
+			return err
+		}
+		var err error
+		res, err = dc.r.Next()
+		return err
+	})
+	return res, err
+}
+
+// run runs f, which reads and writes the connection, with a deadline. When ctx
+// is done the connection is interrupted, and ctx's error is returned. Any
+// error breaks the connection.
+func (dc *dconn) run(ctx context.Context, timeout time.Duration, f func() error) error {
+	if dc.broken {
+		return ErrClosed
+	}
+	// no timeout is no deadline. ctx is dealt with below, so we get ctx's
+	// error, and not a timeout.
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	dc.c.SetDeadline(deadline)
+
+	if ctx.Done() != nil {
+		var (
+			done   = make(chan struct{})
+			exited = make(chan struct{})
+		)
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				// unblocks the read
+				dc.c.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-exited
+		}()
+	}
+
+	if err := f(); err != nil {
+		dc.broken = true
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	return nil
+}
+
+func (dc *dconn) close() error {
+	dc.broken = true
+	return dc.c.Close()
+}
@@ -0,0 +1,57 @@
+package shredis
+
+import (
+	"strings"
+)
+
+// RedisError is an error reply from redis, such as "WRONGTYPE Operation
+// against a key holding the wrong kind of value". Errors from the network are
+// never a RedisError, so use errors.As() to tell them apart.
+type RedisError struct {
+	// Prefix is the first word of the reply, such as "ERR" or "WRONGTYPE".
+	Prefix string
+	// Message is the rest of the reply.
+	Message string
+}
+
+// Errors for common redis error replies, for use with errors.Is(). They match
+// every RedisError with the same prefix.
+var (
+	ErrErr       = &RedisError{Prefix: "ERR"}
+	ErrWrongType = &RedisError{Prefix: "WRONGTYPE"}
+	ErrOOM       = &RedisError{Prefix: "OOM"}
+	ErrNoScript  = &RedisError{Prefix: "NOSCRIPT"}
+	ErrReadOnly  = &RedisError{Prefix: "READONLY"}
+	ErrLoading   = &RedisError{Prefix: "LOADING"}
+	ErrBusy      = &RedisError{Prefix: "BUSY"}
+	ErrNoAuth    = &RedisError{Prefix: "NOAUTH"}
+	ErrExecAbort = &RedisError{Prefix: "EXECABORT"}
+)
+
+func parseRedisError(s string) *RedisError {
+	prefix, msg := s, ""
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		prefix, msg = s[:i], s[i+1:]
+	}
+	return &RedisError{
+		Prefix:  prefix,
+		Message: msg,
+	}
+}
+
+func (e *RedisError) Error() string {
+	if e.Message == "" {
+		return e.Prefix
+	}
+	return e.Prefix + " " + e.Message
+}
+
+// Is makes errors.Is(err, ErrWrongType) work. A RedisError without message
+// matches every RedisError with the same prefix.
+func (e *RedisError) Is(target error) bool {
+	t, ok := target.(*RedisError)
+	if !ok {
+		return false
+	}
+	return t.Prefix == e.Prefix && (t.Message == "" || t.Message == e.Message)
+}
@@ -0,0 +1,65 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+func TestParseRedisError(t *testing.T) {
+	for s, want := range map[string]RedisError{
+		"ERR unknown command 'FOO'": {Prefix: "ERR", Message: "unknown command 'FOO'"},
+		"WRONGTYPE Operation":       {Prefix: "WRONGTYPE", Message: "Operation"},
+		"LOADING":                   {Prefix: "LOADING"},
+	} {
+		e := parseRedisError(s)
+		if have := *e; have != want {
+			t.Errorf("have %#v, want %#v", have, want)
+		}
+		if have, want := e.Error(), s; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+}
+
+func TestRedisError(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("foo", "bar")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	hget := BuildHget("foo", "field")
+	shr.Exec(hget)
+	_, err = hget.Get()
+	if !errors.Is(err, ErrWrongType) {
+		t.Fatalf("have %v, want %v", err, ErrWrongType)
+	}
+	if errors.Is(err, ErrNoScript) {
+		t.Fatalf("%v is not %v", err, ErrNoScript)
+	}
+	var re *RedisError
+	if !errors.As(err, &re) {
+		t.Fatalf("not a RedisError: %v", err)
+	}
+	if have, want := re.Prefix, "WRONGTYPE"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+
+	// network errors are not a RedisError
+	mr.Close()
+	get := BuildGet("foo")
+	shr.ExecMode(context.Background(), ReconnectFail, get)
+	_, err = get.Get()
+	if err == nil || errors.As(err, &re) {
+		t.Fatalf("have %v, want a network error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package shredis
+
+import (
+	"time"
+)
+
+// EventType is the kind of connection event.
+type EventType int
+
+const (
+	// EventDial is sent before every connection attempt.
+	EventDial EventType = iota
+	// EventDialFailed is sent when the TCP connection can't be made.
+	EventDialFailed
+	// EventHandshakeFailed is sent when one of the on-connect commands (AUTH)
+	// fails, on the network level or with an error reply (a wrong password).
+	// The connection is retried with backoff.
+	EventHandshakeFailed
+	// EventConnected is sent when a connection is ready for commands.
+	EventConnected
+	// EventDisconnected is sent when a working connection breaks.
+	EventDisconnected
+	// EventClosed is sent once, when the connection is closed by Close().
+	EventClosed
+	// EventBreakerOpen is sent when the circuit breaker opens.
+	EventBreakerOpen
+	// EventBreakerHalfOpen is sent when the circuit breaker lets a probe
+	// through.
+	EventBreakerHalfOpen
+	// EventBreakerClosed is sent when the circuit breaker closes again.
+	EventBreakerClosed
+	// EventTrackingFailed is sent when the near cache can't track a shard,
+	// because its invalidation connection failed, or because CLIENT TRACKING
+	// gave an error. Nothing is cached for the shard until that works again.
+	// See OptionNearCache.
+	EventTrackingFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventDial:
+		return "dial"
+	case EventDialFailed:
+		return "dial failed"
+	case EventHandshakeFailed:
+		return "handshake failed"
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventClosed:
+		return "closed"
+	case EventBreakerOpen:
+		return "breaker open"
+	case EventBreakerHalfOpen:
+		return "breaker half-open"
+	case EventBreakerClosed:
+		return "breaker closed"
+	case EventTrackingFailed:
+		return "tracking failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change in the connection state of a single shard. Err is set for
+// EventDialFailed, EventHandshakeFailed, EventDisconnected, and
+// EventTrackingFailed.
+type Event struct {
+	Type  EventType
+	Label string
+	Addr  string
+	Err   error
+	Time  time.Time
+}
+
+// EventCB is an optional callback to monitor connection state. It's called from
+// the connection goroutine of the shard, for the breaker events from the
+// goroutine executing the command, and for the tracking events from the near
+// cache's invalidation goroutine, so it should not block.
+type EventCB func(Event)
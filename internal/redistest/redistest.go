@@ -0,0 +1,225 @@
+// Package redistest has a fake redis server and miniredis fixtures, for the
+// tests of shredis and its packages.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+// Handler gives the raw RESP reply for a command. An empty reply sends
+// nothing. It's called from the goroutine of the connection, once for every
+// command and in order, also when the client pipelines them.
+type Handler func(c *Conn, args []string) string
+
+// Conn is a client connection to a Server.
+type Conn struct {
+	// ID is unique per Server, counting from 1.
+	ID     int64
+	c      net.Conn
+	mu     sync.Mutex
+	closed bool
+}
+
+// Write writes a raw RESP reply. It's safe to use from any goroutine, such as
+// for push messages to another connection.
+func (c *Conn) Write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.c, s)
+	return err
+}
+
+// Close closes the connection. Commands which the client already sent are not
+// handled anymore.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.c.Close()
+}
+
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Server is a fake redis server. Make one with NewServer().
+type Server struct {
+	l      net.Listener
+	reply  Handler
+	mu     sync.Mutex
+	conns  map[int64]*Conn
+	nextID int64
+}
+
+// NewServer starts a Server on a random port.
+func NewServer(t testing.TB, h Handler) *Server {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		l:     l,
+		reply: h,
+		conns: map[int64]*Conn{},
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+// Addr is the address to connect to.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Conn gives the client connection with the ID, if it's still there.
+func (s *Server) Conn(id int64) (*Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// Kill closes all client connections, but it keeps accepting new ones.
+func (s *Server) Kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server, and closes all client connections.
+func (s *Server) Close() {
+	s.l.Close()
+	s.Kill()
+}
+
+func (s *Server) serve(nc net.Conn) {
+	s.mu.Lock()
+	s.nextID++
+	c := &Conn{ID: s.nextID, c: nc}
+	s.conns[c.ID] = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c.ID)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+
+	r := bufio.NewReader(nc)
+	for {
+		args, err := readCommand(r)
+		if err != nil || c.isClosed() {
+			return
+		}
+		if res := s.reply(c, args); res != "" {
+			if err := c.Write(res); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a single command, as an array of bulk strings or inline.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("unexpected line: %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Silent is a Handler which never replies.
+func Silent(*Conn, []string) string {
+	return ""
+}
+
+// Flaky gives a Handler which closes the connection on the first `n`
+// commands, counted over all connections. After that it replies with a "bar"
+// bulk string to every command.
+func Flaky(n int) Handler {
+	var mu sync.Mutex
+	return func(c *Conn, args []string) string {
+		mu.Lock()
+		broken := n > 0
+		n--
+		mu.Unlock()
+		if broken {
+			c.Close()
+			return ""
+		}
+		return "$3\r\nbar\r\n"
+	}
+}
+
+// Miniredis starts a miniredis for every label. It gives them in the same
+// order, and a label -> address map for shredis.New().
+func Miniredis(t testing.TB, labels ...string) ([]*miniredis.Miniredis, map[string]string) {
+	var (
+		mrs    []*miniredis.Miniredis
+		shards = map[string]string{}
+	)
+	for _, l := range labels {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mrs = append(mrs, mr)
+		shards[l] = mr.Addr()
+	}
+	return mrs, shards
+}
@@ -0,0 +1,244 @@
+// Package lock is a distributed lock over all shards of a shredis.Shred, with
+// the Redlock algorithm. Every shard is an independent redis, and a lock is
+// held when it's set on a majority of them, within its TTL.
+//
+// See https://redis.io/topics/distlock
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/alicebob/shredis"
+)
+
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = 200 * time.Millisecond
+	defaultDrift      = 0.01
+)
+
+var (
+	// ErrNotAcquired is returned when a lock can't be taken.
+	ErrNotAcquired = errors.New("lock: not acquired")
+	// ErrNotHeld is returned when a lock can't be extended, because it
+	// expired or was taken by someone else.
+	ErrNotHeld = errors.New("lock: not held")
+)
+
+// releaseScript deletes the key, but only if it has our value.
+const releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+else
+	return 0
+end`
+
+// extendScript sets a new TTL on the key, but only if it has our value.
+const extendScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+	return 0
+end`
+
+// Locker takes locks. Make one with New().
+type Locker struct {
+	shr        *shredis.Shred
+	retries    int
+	retryDelay time.Duration
+	drift      float64
+}
+
+// Option is an option to New.
+type Option func(*Locker)
+
+// OptionRetry is an option to New. A lock which can't be taken is tried `n`
+// more times, after a random delay of up to `delay`. Default 3 times, with
+// up to 200ms.
+func OptionRetry(n int, delay time.Duration) Option {
+	return func(l *Locker) {
+		l.retries = n
+		l.retryDelay = delay
+	}
+}
+
+// OptionDrift is an option to New. It's the clock drift between the redis
+// servers, as a fraction of the TTL. Default 0.01.
+func OptionDrift(factor float64) Option {
+	return func(l *Locker) {
+		l.drift = factor
+	}
+}
+
+// New makes a Locker. All shards of shr are used.
+func New(shr *shredis.Shred, options ...Option) *Locker {
+	l := &Locker{
+		shr:        shr,
+		retries:    defaultRetries,
+		retryDelay: defaultRetryDelay,
+		drift:      defaultDrift,
+	}
+	for _, o := range options {
+		o(l)
+	}
+	return l
+}
+
+// Lock is a taken lock.
+type Lock struct {
+	l           *Locker
+	name, value string
+	until       time.Time
+}
+
+// Acquire takes the lock `name` for `ttl`. It gives ErrNotAcquired if that's
+// not possible after all retries, and ctx's error if ctx is done before that.
+// ttl has to be at least a millisecond.
+func (l *Locker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	if err := checkTTL(ttl); err != nil {
+		return nil, err
+	}
+	value, err := randomValue()
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{
+		l:     l,
+		name:  name,
+		value: value,
+	}
+	for try := 0; ; try++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		n, total := l.count(ok, "SET", name, value, "NX", "PX", shredis.FormatMs(ttl))
+		if until, valid := l.validity(start, ttl, n, total); valid {
+			lock.until = until
+			return lock, nil
+		}
+		// undo the partial lock
+		lock.release()
+		if try >= l.retries {
+			return nil, ErrNotAcquired
+		}
+		if err := sleep(ctx, randomDelay(l.retryDelay)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Until is until when the lock is valid.
+func (lock *Lock) Until() time.Time {
+	return lock.until
+}
+
+// Extend gives the lock a new TTL, if it's still held on a majority of the
+// shards. It gives ErrNotHeld otherwise. ttl has to be at least a millisecond.
+func (lock *Lock) Extend(ttl time.Duration) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+	start := time.Now()
+	n, total := lock.l.count(one, "EVAL", extendScript, "1", lock.name, lock.value, shredis.FormatMs(ttl))
+	until, valid := lock.l.validity(start, ttl, n, total)
+	if !valid {
+		return ErrNotHeld
+	}
+	lock.until = until
+	return nil
+}
+
+// Release frees the lock on all shards. It gives ErrNotHeld if the lock
+// already expired on a majority of the shards.
+func (lock *Lock) Release() error {
+	n, total := lock.release()
+	lock.until = time.Time{}
+	if n < total/2+1 {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+func (lock *Lock) release() (int, int) {
+	return lock.l.count(one, "EVAL", releaseScript, "1", lock.name, lock.value)
+}
+
+// count executes a command on all shards, and gives on how many it worked, and
+// the number of shards.
+func (l *Locker) count(worked func(*shredis.Cmd) bool, fields ...string) (int, int) {
+	cmds := l.shr.MapExec(fields...)
+	n := 0
+	for _, c := range cmds {
+		if worked(c) {
+			n++
+		}
+	}
+	return n, len(cmds)
+}
+
+// validity gives until when a lock is valid, if it is.
+func (l *Locker) validity(start time.Time, ttl time.Duration, n, total int) (time.Time, bool) {
+	if n < total/2+1 {
+		return time.Time{}, false
+	}
+	drift := time.Duration(float64(ttl)*l.drift) + 2*time.Millisecond
+	validity := ttl - time.Since(start) - drift
+	if validity <= 0 {
+		return time.Time{}, false
+	}
+	return start.Add(validity), true
+}
+
+// ok is for commands which reply "OK" when they work.
+func ok(c *shredis.Cmd) bool {
+	v, err := c.GetString()
+	return err == nil && v == "OK"
+}
+
+// one is for commands which reply 1 when they work.
+func one(c *shredis.Cmd) bool {
+	v, err := c.GetInt()
+	return err == nil && v == 1
+}
+
+func checkTTL(ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("lock: invalid ttl: %v", ttl)
+	}
+	return nil
+}
+
+func randomValue() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return max
+	}
+	return time.Duration(n.Int64())
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,262 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+// setup starts n miniredis servers, with a shredis.Shred over all of them.
+func setup(t *testing.T, n int) ([]*miniredis.Miniredis, *shredis.Shred) {
+	var labels []string
+	for i := 0; i < n; i++ {
+		labels = append(labels, fmt.Sprintf("shard%d", i))
+	}
+	mrs, shards := redistest.Miniredis(t, labels...)
+	shr := shredis.New(shards)
+	// make sure all connections are up
+	shr.MapExec("PING")
+	return mrs, shr
+}
+
+func TestLock(t *testing.T) {
+	mrs, shr := setup(t, 3)
+	for _, mr := range mrs {
+		defer mr.Close()
+	}
+	defer shr.Close()
+
+	var (
+		ctx = context.Background()
+		l   = New(shr, OptionRetry(0, 0))
+	)
+	lock, err := l.Acquire(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u := lock.Until(); u.Before(time.Now()) || u.After(time.Now().Add(time.Second)) {
+		t.Fatalf("weird validity: %v", u)
+	}
+	for _, mr := range mrs {
+		if !mr.Exists("foo") {
+			t.Fatalf("lock not set")
+		}
+	}
+
+	if _, err := l.Acquire(ctx, "foo", time.Second); err != ErrNotAcquired {
+		t.Fatalf("have %v, want %v", err, ErrNotAcquired)
+	}
+
+	if err := lock.Extend(2 * time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := mrs[0].TTL("foo"), 2*time.Second; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, mr := range mrs {
+		if mr.Exists("foo") {
+			t.Fatalf("lock not released")
+		}
+	}
+	if err := lock.Release(); err != ErrNotHeld {
+		t.Fatalf("have %v, want %v", err, ErrNotHeld)
+	}
+
+	lock, err = l.Acquire(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := lock.Extend(time.Microsecond); err == nil {
+		t.Fatalf("expected an error")
+	}
+	lock.Release()
+
+	if _, err := l.Acquire(ctx, "foo", time.Microsecond); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if mrs[0].Exists("foo") {
+		t.Fatalf("lock set")
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	mrs, shr := setup(t, 3)
+	for _, mr := range mrs {
+		defer mr.Close()
+	}
+	defer shr.Close()
+
+	l := New(shr, OptionRetry(0, 0))
+	lock, err := l.Acquire(context.Background(), "foo", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// someone else has the lock on two shards
+	mrs[0].Set("foo", "other")
+	mrs[1].Set("foo", "other")
+	if err := lock.Extend(time.Second); err != ErrNotHeld {
+		t.Fatalf("have %v, want %v", err, ErrNotHeld)
+	}
+	// and we don't release theirs
+	if err := lock.Release(); err != ErrNotHeld {
+		t.Fatalf("have %v, want %v", err, ErrNotHeld)
+	}
+	if have, _ := mrs[0].Get("foo"); have != "other" {
+		t.Fatalf("have %q, want %q", have, "other")
+	}
+	if mrs[2].Exists("foo") {
+		t.Fatalf("lock not released")
+	}
+}
+
+func TestLockMajority(t *testing.T) {
+	mrs, shr := setup(t, 3)
+	for _, mr := range mrs[1:] {
+		defer mr.Close()
+	}
+	defer shr.Close()
+
+	var (
+		ctx = context.Background()
+		l   = New(shr, OptionRetry(1, 10*time.Millisecond))
+	)
+
+	// one shard dies
+	mrs[0].Close()
+	lock, err := l.Acquire(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the other two have the lock, so no majority
+	if _, err := l.Acquire(ctx, "foo", time.Second); err != ErrNotAcquired {
+		t.Fatalf("have %v, want %v", err, ErrNotAcquired)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a partial lock on a single shard is undone
+	mrs[1].Set("foo", "other")
+	if _, err := l.Acquire(ctx, "foo", time.Second); err != ErrNotAcquired {
+		t.Fatalf("have %v, want %v", err, ErrNotAcquired)
+	}
+	if mrs[2].Exists("foo") {
+		t.Fatalf("partial lock not released")
+	}
+}
+
+func TestLockContext(t *testing.T) {
+	mrs, shr := setup(t, 1)
+	defer mrs[0].Close()
+	defer shr.Close()
+	mrs[0].Set("foo", "other")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	l := New(shr, OptionRetry(100, 100*time.Millisecond))
+	if _, err := l.Acquire(ctx, "foo", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// proxy forwards connections to addr, until kill is called, which also closes
+// all connections.
+func proxy(t *testing.T, addr string) (string, func()) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, c, up)
+			mu.Unlock()
+			go io.Copy(c, up)
+			go io.Copy(up, c)
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestLockKilled(t *testing.T) {
+	var (
+		mrs    []*miniredis.Miniredis
+		shards = map[string]string{}
+		kill   func()
+	)
+	for i := 0; i < 3; i++ {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mr.Close()
+		mrs = append(mrs, mr)
+		addr := mr.Addr()
+		if i == 0 {
+			addr, kill = proxy(t, addr)
+		}
+		shards[fmt.Sprintf("shard%d", i)] = addr
+	}
+	shr := shredis.New(shards)
+	defer shr.Close()
+
+	var (
+		ctx  = context.Background()
+		l    = New(shr, OptionRetry(0, 0))
+		done = make(chan struct{})
+	)
+	// a shard dies while we're busy
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		kill()
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		lock, err := l.Acquire(ctx, "foo", time.Second)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if err := lock.Release(); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,621 @@
+package shredis
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// invalidateChannel is where redis sends invalidations for RESP2 clients.
+	invalidateChannel = "__redis__:invalidate"
+	// trackPing is how often the invalidation connection sends a PING.
+	trackPing = 5 * time.Second
+	// entryOverhead is roughly what an entry costs besides the payload and
+	// the reply.
+	entryOverhead = 64
+)
+
+// nearCacheable are the read commands which can be served by the near cache.
+// They all read a single key, which is the first argument.
+var nearCacheable = map[string]bool{
+	"BITCOUNT":         true,
+	"GEODIST":          true,
+	"GEOHASH":          true,
+	"GEOPOS":           true,
+	"GET":              true,
+	"GETBIT":           true,
+	"GETRANGE":         true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"HSTRLEN":          true,
+	"HVALS":            true,
+	"LINDEX":           true,
+	"LLEN":             true,
+	"LRANGE":           true,
+	"SCARD":            true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"STRLEN":           true,
+	"TYPE":             true,
+	"XLEN":             true,
+	"XRANGE":           true,
+	"XREVRANGE":        true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZLEXCOUNT":        true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCORE":           true,
+}
+
+// NearCacheConfig configures the near cache. See OptionNearCache.
+type NearCacheConfig struct {
+	// MaxEntries is the max number of cached replies. 0 is no limit.
+	MaxEntries int
+	// MaxBytes is the max size of the cached replies. It's an estimate. 0 is
+	// no limit.
+	MaxBytes int
+}
+
+// NearCacheStats are the counters of the near cache. See
+// Shred.NearCacheStats().
+type NearCacheStats struct {
+	// Hits and Misses count the cacheable commands.
+	Hits, Misses int64
+	// Invalidations are the entries removed because the key changed, by a
+	// write through this Shred or according to redis.
+	Invalidations int64
+	// Evictions are the entries removed because of the size limits.
+	Evictions int64
+	// Entries and Bytes are the current size.
+	Entries, Bytes int
+}
+
+// OptionNearCache is an option to New. It keeps the replies of read commands
+// (GET, HGETALL, ZRANGE, ...) in memory, and Exec() serves those commands
+// from memory until redis says the key changed. Other commands might be
+// writes: before they are sent, and for blocking commands and Conn.Exec() also
+// after they are done, the cache of their shard drops everything for all their
+// arguments. So a read after a write through the same Shred sees the write,
+// with every way to execute commands.
+//
+// Invalidation uses redis' server assisted client side caching (redis 6+):
+// every shard gets an extra connection which subscribes to the invalidation
+// messages, and the normal connection does a CLIENT TRACKING with a REDIRECT
+// to that. When either connection breaks the cache for that shard is dropped,
+// and nothing is cached until both are back. Both connections send a PING
+// when they are idle for 5s (or the OptionHealthCheck interval, if that's
+// shorter), so a connection which redis dropped is found. Against servers
+// without CLIENT TRACKING nothing gets cached.
+//
+// Only use it for Exec()s without MULTI or WATCH.
+func OptionNearCache(c NearCacheConfig) Option {
+	return func(s *Shred) {
+		s.nearCache = &c
+	}
+}
+
+// NearCacheStats gives the counters of the near cache. They're all 0 without
+// OptionNearCache.
+func (s *Shred) NearCacheStats() NearCacheStats {
+	if s.near == nil {
+		return NearCacheStats{}
+	}
+	return s.near.getStats()
+}
+
+// nearEntry is a cached reply. Until it's filled it's a placeholder for a
+// reply which is on its way. An invalidation removes the placeholder, and the
+// reply won't be stored.
+type nearEntry struct {
+	slot   int
+	key    string
+	req    string
+	res    interface{}
+	size   int
+	filled bool
+	elem   *list.Element
+}
+
+// nearShard is the near cache state of a single shard.
+type nearShard struct {
+	// keys is redis key -> payload -> entry.
+	keys map[string]map[string]*nearEntry
+	// id is the CLIENT ID of the invalidation connection, 0 if there is none.
+	// gen changes on every new invalidation connection.
+	id  int64
+	gen int
+	// on is whether the normal connection has tracking enabled to the
+	// invalidation connection.
+	on bool
+}
+
+// nearCache is the in process cache of OptionNearCache. Goroutine safe.
+type nearCache struct {
+	cfg    NearCacheConfig
+	mu     sync.Mutex
+	shards []nearShard
+	// lru has the filled entries, most recently used in front.
+	lru   *list.List
+	stats NearCacheStats
+}
+
+// nearFill is a command whose reply goes in a placeholder.
+type nearFill struct {
+	e   *nearEntry
+	cmd *Cmd
+}
+
+func newNearCache(cfg NearCacheConfig, n int) *nearCache {
+	nc := &nearCache{
+		cfg:    cfg,
+		shards: make([]nearShard, n),
+		lru:    list.New(),
+	}
+	for i := range nc.shards {
+		nc.shards[i].keys = map[string]map[string]*nearEntry{}
+	}
+	return nc
+}
+
+// get serves the commands it can from the cache. It returns the commands
+// which still need to be executed, and the placeholders for their replies.
+// For the other commands it does what dropWrites() does.
+func (nc *nearCache) get(ket continuum, cmds []*Cmd) ([]*Cmd, []nearFill) {
+	multi := false
+	for _, c := range cmds {
+		if c.multi {
+			multi = true
+			break
+		}
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	var (
+		rest  []*Cmd
+		fills []nearFill
+	)
+	for _, c := range cmds {
+		if !c.near {
+			nc.dropArgs(ket.Slot(c.hash), c.payload)
+			rest = append(rest, c)
+			continue
+		}
+		slot := ket.Slot(c.hash)
+		sh := &nc.shards[slot]
+		if multi || !sh.on {
+			rest = append(rest, c)
+			continue
+		}
+		req := string(c.payload)
+		if e := sh.keys[c.nearKey][req]; e != nil {
+			if e.filled {
+				nc.stats.Hits++
+				nc.lru.MoveToFront(e.elem)
+				c.set(copyReply(e.res), nil)
+				continue
+			}
+			// someone else is already reading it
+			nc.stats.Misses++
+			rest = append(rest, c)
+			continue
+		}
+		nc.stats.Misses++
+		e := &nearEntry{
+			slot: slot,
+			key:  c.nearKey,
+			req:  req,
+		}
+		if sh.keys[e.key] == nil {
+			sh.keys[e.key] = map[string]*nearEntry{}
+		}
+		sh.keys[e.key][req] = e
+		fills = append(fills, nearFill{e: e, cmd: c})
+		rest = append(rest, c)
+	}
+	return rest, fills
+}
+
+// fill stores the replies, if their placeholders are still there.
+func (nc *nearCache) fill(fills []nearFill) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for _, f := range fills {
+		e := f.e
+		if nc.shards[e.slot].keys[e.key][e.req] != e {
+			// invalidated while we waited
+			continue
+		}
+		if f.cmd.err != nil {
+			nc.remove(e)
+			continue
+		}
+		e.res = copyReply(f.cmd.res)
+		e.size = entryOverhead + len(e.key) + len(e.req) + replySize(e.res)
+		e.filled = true
+		e.elem = nc.lru.PushFront(e)
+		nc.stats.Entries++
+		nc.stats.Bytes += e.size
+	}
+	for nc.stats.Entries > 0 &&
+		(nc.cfg.MaxEntries > 0 && nc.stats.Entries > nc.cfg.MaxEntries ||
+			nc.cfg.MaxBytes > 0 && nc.stats.Bytes > nc.cfg.MaxBytes) {
+		nc.remove(nc.lru.Back().Value.(*nearEntry))
+		nc.stats.Evictions++
+	}
+}
+
+// remove removes an entry or a placeholder. Must hold the lock.
+func (nc *nearCache) remove(e *nearEntry) {
+	sh := &nc.shards[e.slot]
+	delete(sh.keys[e.key], e.req)
+	if len(sh.keys[e.key]) == 0 {
+		delete(sh.keys, e.key)
+	}
+	if e.filled {
+		nc.lru.Remove(e.elem)
+		nc.stats.Entries--
+		nc.stats.Bytes -= e.size
+	}
+}
+
+// invalidate removes everything cached for the keys.
+func (nc *nearCache) invalidate(slot int, keys []string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for _, k := range keys {
+		nc.drop(slot, k)
+	}
+}
+
+// drop removes everything cached for a key. Must hold the lock.
+func (nc *nearCache) drop(slot int, key string) {
+	for _, e := range nc.shards[slot].keys[key] {
+		if e.filled {
+			nc.stats.Invalidations++
+		}
+		nc.remove(e)
+	}
+}
+
+// dropWrites removes what's cached on shard slot for all arguments of the
+// commands which the cache can't serve. Those might be writes, and redis'
+// invalidation comes too late for a read right after them. Arguments which
+// are not keys just don't match anything. A nil nearCache does nothing.
+func (nc *nearCache) dropWrites(slot int, cmds ...*Cmd) {
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for _, c := range cmds {
+		if !c.near {
+			nc.dropArgs(slot, c.payload)
+		}
+	}
+}
+
+// dropArgs drops all arguments of a command payload. Must hold the lock.
+func (nc *nearCache) dropArgs(slot int, payload []byte) {
+	keys := nc.shards[slot].keys
+	if len(keys) == 0 {
+		return
+	}
+	eachArg(payload, func(arg []byte) {
+		if _, ok := keys[string(arg)]; ok {
+			nc.drop(slot, string(arg))
+		}
+	})
+}
+
+// eachArg calls f with all arguments of a command payload, but not with the
+// command name. It doesn't allocate.
+func eachArg(payload []byte, f func([]byte)) {
+	// *<n>\r\n$<len>\r\n<name>\r\n$<len>\r\n<arg>\r\n...
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		return
+	}
+	p := payload[i+1:]
+	for first := true; len(p) > 0 && p[0] == '$'; first = false {
+		n, j := 0, 1
+		for ; j < len(p) && '0' <= p[j] && p[j] <= '9'; j++ {
+			n = n*10 + int(p[j]-'0')
+		}
+		p = p[j:]
+		if len(p) < 2+n+2 {
+			return
+		}
+		if !first {
+			f(p[2 : 2+n])
+		}
+		p = p[2+n+2:]
+	}
+}
+
+// clear drops the cache of a shard, and stops caching until tracking is
+// enabled again.
+func (nc *nearCache) clear(slot int) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.clearLocked(slot)
+}
+
+func (nc *nearCache) clearLocked(slot int) {
+	sh := &nc.shards[slot]
+	for _, es := range sh.keys {
+		for _, e := range es {
+			nc.remove(e)
+		}
+	}
+	sh.on = false
+}
+
+// setRedirect sets the CLIENT ID of a new invalidation connection, or 0 if
+// it's gone. It returns the new generation.
+func (nc *nearCache) setRedirect(slot int, id int64) int {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.clearLocked(slot)
+	sh := &nc.shards[slot]
+	sh.id = id
+	sh.gen++
+	return sh.gen
+}
+
+// redirect gives the current CLIENT ID of the invalidation connection, and its
+// generation.
+func (nc *nearCache) redirect(slot int) (int64, int) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	sh := &nc.shards[slot]
+	return sh.id, sh.gen
+}
+
+// enable starts caching, if the invalidation connection is still the one
+// tracking was enabled for.
+func (nc *nearCache) enable(slot, gen int) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if sh := &nc.shards[slot]; sh.gen == gen && sh.id != 0 {
+		sh.on = true
+	}
+}
+
+// tracking is whether a shard is being cached.
+func (nc *nearCache) tracking(slot int) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.shards[slot].on
+}
+
+func (nc *nearCache) getStats() NearCacheStats {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.stats
+}
+
+// handshake enables tracking on a new normal connection, if there is an
+// invalidation connection. Servers which don't know CLIENT TRACKING are not an
+// error, we just don't cache anything.
+func (nc *nearCache) handshake(conn net.Conn, r *replyReader, slot int) error {
+	nc.clear(slot)
+	id, gen := nc.redirect(slot)
+	if id == 0 {
+		// the invalidation connection will enable it
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(connTimeout))
+	if _, err := conn.Write(buildTracking(id).payload); err != nil {
+		return err
+	}
+	res, err := r.Next()
+	if err != nil {
+		return err
+	}
+	if _, ok := res.(error); ok {
+		return nil
+	}
+	nc.enable(slot, gen)
+	return nil
+}
+
+func buildTracking(id int64) *Cmd {
+	return Build("", "CLIENT", "TRACKING", "on", "REDIRECT", strconv.FormatInt(id, 10))
+}
+
+// copyReply copies the arrays in a reply, so callers can't change a cached
+// reply. Everything else in a reply is immutable.
+func copyReply(res interface{}) interface{} {
+	r, ok := res.([]interface{})
+	if !ok || r == nil {
+		return res
+	}
+	c := make([]interface{}, len(r))
+	for i, v := range r {
+		c[i] = copyReply(v)
+	}
+	return c
+}
+
+// replySize estimates the memory used by a reply.
+func replySize(res interface{}) int {
+	switch r := res.(type) {
+	case string:
+		return len(r)
+	case []interface{}:
+		n := 0
+		for _, v := range r {
+			n += 16 + replySize(v)
+		}
+		return n
+	default:
+		return 8
+	}
+}
+
+// track keeps an invalidation connection to a shard, until Shutdown().
+func (s *Shred) track(slot int) {
+	defer s.connwg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	b := newBackoff(s.backoffMin, s.backoffMax)
+	for {
+		err := s.trackConn(ctx, slot, b)
+		s.near.setRedirect(slot, 0)
+		if ctx.Err() == nil {
+			s.trackFailed(slot, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.next()):
+		}
+	}
+}
+
+// trackFailed sends an EventTrackingFailed.
+func (s *Shred) trackFailed(slot int, err error) {
+	sh := s.shards[slot]
+	s.eventCB(Event{
+		Type:  EventTrackingFailed,
+		Label: sh.label,
+		Addr:  sh.addr,
+		Err:   err,
+		Time:  time.Now(),
+	})
+}
+
+// trackConn runs a single invalidation connection, until it breaks.
+func (s *Shred) trackConn(ctx context.Context, slot int, b *backoff) error {
+	sh := s.shards[slot]
+	dc, err := s.dial(ctx, sh.addr)
+	if err != nil {
+		return err
+	}
+	defer dc.close()
+
+	var (
+		id  = Build("", "CLIENT", "ID")
+		sub = Build("", "SUBSCRIBE", invalidateChannel)
+	)
+	if err := dc.doAll(ctx, []*Cmd{id, sub}, connTimeout); err != nil {
+		return err
+	}
+	n, err := id.GetInt64()
+	if err != nil {
+		return err
+	}
+	if _, err := sub.Get(); err != nil {
+		return err
+	}
+	b.reset()
+	gen := s.near.setRedirect(slot, n)
+
+	// Enable tracking on the normal connection. If that's not connected
+	// right now its handshake will do it.
+	var (
+		tr = buildTracking(n)
+		wg sync.WaitGroup
+	)
+	wg.Add(1)
+	s.exec(sh, action{
+		cmds: []*Cmd{tr},
+		wg:   &wg,
+	})
+	wg.Wait()
+	_, err = tr.Get()
+	var rerr *RedisError
+	switch {
+	case err == nil:
+		s.near.enable(slot, gen)
+	case errors.As(err, &rerr):
+		// such as a server without CLIENT TRACKING
+		s.trackFailed(slot, err)
+	}
+
+	// PINGs keep the read deadline from expiring, and find dead
+	// connections.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ping := Build("", "PING")
+		t := time.NewTicker(trackPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				dc.c.SetWriteDeadline(time.Now().Add(connTimeout))
+				dc.c.Write(ping.payload)
+			case <-ctx.Done():
+				dc.c.Close()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		dc.c.SetReadDeadline(time.Now().Add(trackPing + connTimeout))
+		res, err := dc.r.Next()
+		if err != nil {
+			return err
+		}
+		// ["message", channel, [keys...]], with nil keys for a FLUSHALL.
+		msg, ok := res.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		switch keys := msg[2].(type) {
+		case nil:
+			s.near.clearKeys(slot)
+		case []interface{}:
+			var ks []string
+			for _, k := range keys {
+				if k, ok := k.(string); ok {
+					ks = append(ks, k)
+				}
+			}
+			s.near.invalidate(slot, ks)
+		default:
+			return fmt.Errorf("unexpected invalidation: %v", msg[2])
+		}
+	}
+}
+
+// clearKeys drops the cache of a shard, but keeps caching.
+func (nc *nearCache) clearKeys(slot int) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	sh := &nc.shards[slot]
+	on := sh.on
+	nc.clearLocked(slot)
+	sh.on = on
+}
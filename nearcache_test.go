@@ -0,0 +1,549 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+// trackingServer is a fake redis with just enough CLIENT TRACKING, since
+// miniredis doesn't have it.
+type trackingServer struct {
+	*redistest.Server
+	mu sync.Mutex
+	// values are the GET/SET keys, lists the RPUSH/LRANGE keys.
+	values map[string]string
+	lists  map[string][]string
+	// gets counts the GETs.
+	gets int
+	// redirects is client ID -> redirect ID. subscribed are the client IDs
+	// which did a SUBSCRIBE.
+	redirects  map[int64]int64
+	subscribed map[int64]bool
+	// tracked is key -> redirect IDs.
+	tracked map[string]map[int64]bool
+}
+
+func newTrackingServer(t *testing.T) *trackingServer {
+	ts := &trackingServer{
+		values:     map[string]string{},
+		lists:      map[string][]string{},
+		redirects:  map[int64]int64{},
+		subscribed: map[int64]bool{},
+		tracked:    map[string]map[int64]bool{},
+	}
+	ts.Server = redistest.NewServer(t, ts.reply)
+	return ts
+}
+
+// killTracked closes the client connections which have tracking enabled, but
+// not the connections which get the invalidations.
+func (ts *trackingServer) killTracked() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for id := range ts.redirects {
+		if c, ok := ts.Conn(id); ok {
+			c.Close()
+		}
+	}
+}
+
+func (ts *trackingServer) getCount() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.gets
+}
+
+func (ts *trackingServer) reply(c *redistest.Conn, args []string) string {
+	id := c.ID
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	switch strings.ToUpper(args[0]) + " " + strings.ToUpper(args[1%len(args)]) {
+	case "CLIENT ID":
+		return fmt.Sprintf(":%d\r\n", id)
+	case "CLIENT TRACKING":
+		to, _ := strconv.ParseInt(args[4], 10, 64)
+		ts.redirects[id] = to
+		return "+OK\r\n"
+	}
+	switch strings.ToUpper(args[0]) {
+	case "SUBSCRIBE":
+		ts.subscribed[id] = true
+		return fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+	case "PING":
+		if ts.subscribed[id] {
+			return "*2\r\n$4\r\npong\r\n$0\r\n\r\n"
+		}
+		return "+PONG\r\n"
+	case "GET":
+		ts.gets++
+		ts.track(id, args[1])
+		v, ok := ts.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		ts.values[args[1]] = args[2]
+		ts.invalidate(args[1])
+		return "+OK\r\n"
+	case "LRANGE":
+		// always the whole list
+		ts.track(id, args[1])
+		l := ts.lists[args[1]]
+		r := fmt.Sprintf("*%d\r\n", len(l))
+		for _, v := range l {
+			r += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		}
+		return r
+	case "RPUSH":
+		ts.lists[args[1]] = append(ts.lists[args[1]], args[2:]...)
+		ts.invalidate(args[1])
+		return fmt.Sprintf(":%d\r\n", len(ts.lists[args[1]]))
+	case "BLPOP":
+		// never blocks, and only the first key
+		l := ts.lists[args[1]]
+		if len(l) == 0 {
+			return "*-1\r\n"
+		}
+		ts.lists[args[1]] = l[1:]
+		ts.invalidate(args[1])
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(l[0]), l[0])
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := ts.values[k]; ok {
+				n++
+			}
+			delete(ts.values, k)
+			ts.invalidate(k)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "MSET":
+		for i := 1; i+1 < len(args); i += 2 {
+			ts.values[args[i]] = args[i+1]
+			ts.invalidate(args[i])
+		}
+		return "+OK\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// track remembers that a client read key. Must hold the lock.
+func (ts *trackingServer) track(id int64, key string) {
+	to, ok := ts.redirects[id]
+	if !ok {
+		return
+	}
+	if ts.tracked[key] == nil {
+		ts.tracked[key] = map[int64]bool{}
+	}
+	ts.tracked[key][to] = true
+}
+
+// invalidate tells the clients which read key that it changed. Must hold the
+// lock.
+func (ts *trackingServer) invalidate(key string) {
+	for to := range ts.tracked[key] {
+		if rc, ok := ts.Conn(to); ok {
+			rc.Write(fmt.Sprintf(
+				"*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n*1\r\n$%d\r\n%s\r\n",
+				len(invalidateChannel), invalidateChannel, len(key), key,
+			))
+		}
+	}
+	delete(ts.tracked, key)
+}
+
+// waitFor polls f for a while.
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func TestNearCache(t *testing.T) {
+	ts := newTrackingServer(t)
+	defer ts.Close()
+
+	shr := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxEntries: 100}))
+	defer shr.Close()
+
+	set := BuildSet("foo", "bar")
+	shr.Exec(set)
+	if _, err := set.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		t.Helper()
+		g := BuildGet("foo")
+		shr.Exec(g)
+		v, err := g.GetString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	waitFor(t, "caching", func() bool {
+		get()
+		return shr.NearCacheStats().Hits > 0
+	})
+
+	n := ts.getCount()
+	for i := 0; i < 10; i++ {
+		if have, want := get(), "bar"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+	if have, want := ts.getCount(), n; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+	if have, want := shr.NearCacheStats().Entries, 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+	if !shr.Status()[0].Tracking {
+		t.Errorf("not tracking")
+	}
+
+	// our own write invalidates right away
+	set = BuildSet("foo", "baz")
+	shr.Exec(set)
+	if _, err := set.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := get(), "baz"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have := shr.NearCacheStats().Invalidations; have < 1 {
+		t.Errorf("have %d invalidations", have)
+	}
+
+	// and so does redis, for writes from elsewhere
+	waitFor(t, "caching", func() bool {
+		hits := shr.NearCacheStats().Hits
+		get()
+		return shr.NearCacheStats().Hits > hits
+	})
+	ts.mu.Lock()
+	ts.values["foo"] = "qux"
+	ts.invalidate("foo")
+	ts.mu.Unlock()
+	waitFor(t, "invalidation", func() bool {
+		return get() == "qux"
+	})
+
+	// missing keys are cached just the same
+	for i := 0; i < 3; i++ {
+		g := BuildGet("nosuch")
+		shr.Exec(g)
+		if _, ok, err := g.GetStringOK(); err != nil || ok {
+			t.Fatalf("have %v %v", ok, err)
+		}
+	}
+	if have, want := shr.NearCacheStats().Entries, 2; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestNearCacheEvict(t *testing.T) {
+	ts := newTrackingServer(t)
+	defer ts.Close()
+
+	shr := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxEntries: 2}))
+	defer shr.Close()
+
+	waitFor(t, "caching", func() bool {
+		shr.Exec(BuildGet("a"))
+		return shr.NearCacheStats().Hits > 0
+	})
+	for _, k := range []string{"a", "b", "c", "a"} {
+		shr.Exec(BuildGet(k))
+	}
+	st := shr.NearCacheStats()
+	if have, want := st.Entries, 2; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+	if have, want := st.Evictions, int64(2); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestNearCacheReconnect(t *testing.T) {
+	ts := newTrackingServer(t)
+	defer ts.Close()
+
+	shr := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxBytes: 10000}), OptionBackoff(time.Millisecond, 10*time.Millisecond))
+	defer shr.Close()
+
+	waitFor(t, "caching", func() bool {
+		shr.Exec(BuildGet("a"))
+		return shr.NearCacheStats().Hits > 0
+	})
+
+	// invalidations might have been lost, so everything goes
+	ts.Kill()
+	waitFor(t, "clear", func() bool {
+		return shr.NearCacheStats().Entries == 0
+	})
+	hits := shr.NearCacheStats().Hits
+	waitFor(t, "caching again", func() bool {
+		shr.Exec(BuildGet("a"))
+		return shr.NearCacheStats().Hits > hits
+	})
+}
+
+func TestNearCacheIdleKilled(t *testing.T) {
+	ts := newTrackingServer(t)
+	defer ts.Close()
+
+	shr := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxEntries: 100}), OptionHealthCheck(20*time.Millisecond), OptionBackoff(time.Millisecond, 10*time.Millisecond))
+	defer shr.Close()
+
+	set := BuildSet("foo", "bar")
+	shr.Exec(set)
+	if _, err := set.Get(); err != nil {
+		t.Fatal(err)
+	}
+	get := func() string {
+		t.Helper()
+		g := BuildGet("foo")
+		shr.Exec(g)
+		v, err := g.GetString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	waitFor(t, "caching", func() bool {
+		get()
+		return shr.NearCacheStats().Hits > 0
+	})
+
+	// the health check is always on
+	plain := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{}))
+	plain.Close()
+	if have, want := plain.healthCheck, trackPing; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// redis drops the idle connection, and with it the tracking, so this
+	// change is never announced.
+	ts.killTracked()
+	ts.mu.Lock()
+	ts.values["foo"] = "baz"
+	ts.mu.Unlock()
+	waitFor(t, "clear", func() bool {
+		return get() == "baz"
+	})
+}
+
+func TestNearCacheNoTracking(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("foo", "bar")
+
+	var (
+		mu     sync.Mutex
+		failed []error
+	)
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxEntries: 100}), OptionEvents(func(e Event) {
+		if e.Type == EventTrackingFailed {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, e.Err)
+		}
+	}))
+	defer shr.Close()
+
+	for i := 0; i < 5; i++ {
+		get := BuildGet("foo")
+		shr.Exec(get)
+		if v, err := get.GetString(); err != nil || v != "bar" {
+			t.Fatalf("have %q %v", v, err)
+		}
+	}
+	if have, want := shr.NearCacheStats(), (NearCacheStats{}); have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+	if shr.Status()[0].Tracking {
+		t.Errorf("tracking")
+	}
+	waitFor(t, "event", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failed) > 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !errors.Is(failed[0], ErrErr) {
+		t.Errorf("have %v, want %v", failed[0], ErrErr)
+	}
+}
+
+func TestNearCacheCopy(t *testing.T) {
+	ts := newTrackingServer(t)
+	defer ts.Close()
+
+	shr := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxEntries: 100}))
+	defer shr.Close()
+
+	push := Build("list", "RPUSH", "list", "a", "b")
+	shr.Exec(push)
+	if _, err := push.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing a reply doesn't change the cache, also not for the reply
+	// which filled it
+	get := func() []interface{} {
+		t.Helper()
+		c := Build("list", "LRANGE", "list", "0", "-1")
+		shr.Exec(c)
+		v, err := c.GetSlice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := v, []interface{}{"a", "b"}; !reflect.DeepEqual(have, want) {
+			t.Fatalf("have %v, want %v", have, want)
+		}
+		v[0] = "changed"
+		return v
+	}
+	waitFor(t, "caching", func() bool {
+		get()
+		return shr.NearCacheStats().Hits > 0
+	})
+	for i := 0; i < 3; i++ {
+		get()
+	}
+}
+
+func TestNearCacheWrites(t *testing.T) {
+	ts := newTrackingServer(t)
+	defer ts.Close()
+
+	shr := New(map[string]string{
+		"shard0": ts.Addr(),
+	}, OptionNearCache(NearCacheConfig{MaxEntries: 100}))
+	defer shr.Close()
+
+	get := func(key string) string {
+		t.Helper()
+		g := BuildGet(key)
+		shr.Exec(g)
+		v, err := g.GetString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// cache waits until key is served from the cache
+	cache := func(keys ...string) {
+		t.Helper()
+		for _, k := range keys {
+			waitFor(t, "caching", func() bool {
+				hits := shr.NearCacheStats().Hits
+				get(k)
+				return shr.NearCacheStats().Hits > hits
+			})
+		}
+	}
+	exec := func(c *Cmd) {
+		t.Helper()
+		shr.Exec(c)
+		if _, err := c.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// all keys of a write, not only the first one
+	exec(Build("a", "MSET", "a", "1", "b", "1"))
+	cache("a", "b")
+	exec(Build("a", "MSET", "a", "2", "b", "2"))
+	if have, want := get("a")+get("b"), "22"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	cache("a", "b")
+	exec(Build("a", "DEL", "a", "b"))
+	if have, want := get("a")+get("b"), ""; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// ShardExec
+	cache("a")
+	if err := shr.ShardExec("shard0", BuildSet("a", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := get("a"), "3"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// Conn
+	cache("a")
+	ctx := context.Background()
+	conn, err := shr.Conn(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Exec(ctx, BuildSet("a", "4")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if have, want := get("a"), "4"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// blocking commands
+	exec(Build("list", "RPUSH", "list", "x", "y"))
+	lrange := func() []string {
+		t.Helper()
+		c := Build("list", "LRANGE", "list", "0", "-1")
+		shr.Exec(c)
+		v, err := c.GetStrings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	waitFor(t, "caching", func() bool {
+		hits := shr.NearCacheStats().Hits
+		lrange()
+		return shr.NearCacheStats().Hits > hits
+	})
+	exec(Build("list", "BLPOP", "list", "1"))
+	if have, want := lrange(), []string{"y"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
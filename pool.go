@@ -0,0 +1,96 @@
+package shredis
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultPoolSize = 2
+
+// connPool keeps dedicated connections to a single shard. There is no limit
+// on the number of connections in use, only on how many idle ones are kept.
+type connPool struct {
+	addr string
+	size int
+	dial func(ctx context.Context, addr string) (*dconn, error)
+
+	mu     sync.Mutex
+	idle   []*dconn
+	active map[*dconn]struct{}
+	closed bool
+}
+
+func newConnPool(addr string, size int, dial func(context.Context, string) (*dconn, error)) *connPool {
+	return &connPool{
+		addr:   addr,
+		size:   size,
+		dial:   dial,
+		active: map[*dconn]struct{}{},
+	}
+}
+
+// get gives an idle connection, or dials a new one.
+func (p *connPool) get(ctx context.Context) (*dconn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		dc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.active[dc] = struct{}{}
+		p.mu.Unlock()
+		return dc, nil
+	}
+	p.mu.Unlock()
+
+	dc, err := p.dial(ctx, p.addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		dc.close()
+		return nil, ErrClosed
+	}
+	p.active[dc] = struct{}{}
+	return dc, nil
+}
+
+// put gives a connection back. Broken connections are closed, and so are
+// connections which don't fit.
+func (p *connPool) put(dc *dconn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, dc)
+	if dc.broken || p.closed || len(p.idle) >= p.size {
+		dc.close()
+		return
+	}
+	p.idle = append(p.idle, dc)
+}
+
+// isClosed is whether close() has been called.
+func (p *connPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// close closes all connections, including the ones in use. Commands on those
+// fail.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, dc := range p.idle {
+		dc.close()
+	}
+	p.idle = nil
+	for dc := range p.active {
+		// not dc.close(), the connection is used by another goroutine
+		dc.c.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package shredis
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// defaultQueueDepth is the number of actions which can wait for a
+	// connection.
+	defaultQueueDepth = 5
+)
+
+// ErrQueueFull is the error for commands which didn't fit in the queue of a
+// shard. See OptionOverflow.
+var ErrQueueFull = errors.New("queue full")
+
+// OverflowPolicy decides what Exec does when the queue of a shard is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room. This is the default.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowFail fails the commands right away with ErrQueueFull.
+	OverflowFail
+	// OverflowTimeout waits for room, but fails the commands with
+	// ErrQueueFull after a timeout.
+	OverflowTimeout
+)
+
+// OptionQueueDepth is an option to New. It sets how many Exec() batches can
+// wait for every shard, while the connection is busy with earlier commands.
+// The default is 5. See OptionOverflow for what happens when the queue is full.
+func OptionQueueDepth(n int) Option {
+	return func(s *Shred) {
+		s.queueDepth = n
+	}
+}
+
+// OptionOverflow is an option to New. It sets what happens to commands for a
+// shard whose queue is full. The timeout is only used for OverflowTimeout.
+func OptionOverflow(p OverflowPolicy, timeout time.Duration) Option {
+	return func(s *Shred) {
+		s.overflow = p
+		s.overflowTimeout = timeout
+	}
+}
+
+// QueueDepth gives the number of Exec() batches waiting for the shard of
+// `key`. Useful for load shedding.
+func (s *Shred) QueueDepth(key string) int {
+	return len(s.shards[s.ket.Slot(hashKey(key))].conn)
+}
+
+// send puts an action in the queue of a conn, according to the overflow
+// policy. Returns false if it didn't fit. The context of the action and
+// Shutdown() also end the wait.
+func (s *Shred) send(c conn, a action) bool {
+	select {
+	case c <- a:
+		return true
+	default:
+	}
+
+	var done <-chan struct{}
+	if a.ctx != nil {
+		done = a.ctx.Done()
+	}
+	switch s.overflow {
+	case OverflowFail:
+		a.doneError(ErrQueueFull)
+		return false
+	case OverflowTimeout:
+		t := time.NewTimer(s.overflowTimeout)
+		defer t.Stop()
+		select {
+		case c <- a:
+			return true
+		case <-t.C:
+			a.doneError(ErrQueueFull)
+			return false
+		case <-done:
+			a.doneError(a.ctx.Err())
+			return false
+		case <-s.closing:
+			a.doneError(ErrClosed)
+			return false
+		}
+	default:
+		select {
+		case c <- a:
+			return true
+		case <-done:
+			a.doneError(a.ctx.Err())
+			return false
+		case <-s.closing:
+			a.doneError(ErrClosed)
+			return false
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+// shutdownNow closes a Shred without waiting for outstanding commands.
+func shutdownNow(shr *Shred) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	shr.Shutdown(ctx)
+}
+
+func TestQueueFull(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	},
+		OptionQueueDepth(1),
+		OptionOverflow(OverflowTimeout, 20*time.Millisecond),
+	)
+	defer shutdownNow(shr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// One in flight, one in the queue.
+	for i := 0; i < 2; i++ {
+		go shr.Exec(BuildGet("foo"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if have, want := shr.QueueDepth("foo"), 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+	if have, want := shr.Status()[0].QueueDepth, 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	get := BuildGet("foo")
+	n := time.Now()
+	shr.Exec(get)
+	if _, err := get.Get(); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("have %v, want %v", err, ErrQueueFull)
+	}
+	if d := time.Since(n); d < 20*time.Millisecond {
+		t.Fatalf("didn't wait: %s", d)
+	}
+
+	// the context is also used
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	get = BuildGet("foo")
+	shr.ExecMode(ctx, ReconnectDefault, get)
+	if _, err := get.Get(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestQueueFail(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	},
+		OptionQueueDepth(1),
+		OptionOverflow(OverflowFail, 0),
+	)
+	defer shutdownNow(shr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go shr.Exec(BuildGet("foo"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := BuildGet("foo")
+	n := time.Now()
+	shr.Exec(get)
+	if _, err := get.Get(); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("have %v, want %v", err, ErrQueueFull)
+	}
+	if d := time.Since(n); d > 10*time.Millisecond {
+		t.Fatalf("waited too long: %s", d)
+	}
+}
@@ -0,0 +1,325 @@
+// Package ratelimit has rate limiters which keep their state in redis, on top
+// of a shredis.Shred. Every limiter key lives on its own shard, and all logic
+// runs in a Lua script, so many processes can share a limit. The scripts are
+// run with EVALSHA, and only sent in full when redis doesn't have them yet.
+// Checks for many keys can be batched in a single pipelined Exec().
+//
+// The time comes from the clients, so their clocks should be in sync.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alicebob/shredis"
+)
+
+// tokenBucketScript takes n tokens from a bucket which fills with rate tokens
+// per second, up to burst. The state is a hash with the number of tokens and
+// the time of the last update.
+const tokenBucketScript = `local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+	ts = now
+end
+local allowed = 0
+local retry = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+elseif n > burst then
+	retry = -1
+else
+	retry = math.ceil((n - tokens) * 1000 / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, math.floor(tokens), retry}`
+
+// slidingLogScript logs every event in a sorted set, with the time as score,
+// and allows n more events if there are fewer than limit in the window.
+const slidingLogScript = `local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+local retry = 0
+if count + n <= limit then
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], now, ARGV[5] .. ":" .. i)
+	end
+	count = count + n
+	allowed = 1
+elseif n > limit then
+	retry = -1
+else
+	local first = redis.call("ZRANGE", KEYS[1], count + n - limit - 1, count + n - limit - 1, "WITHSCORES")
+	retry = tonumber(first[2]) + window - now
+end
+redis.call("PEXPIRE", KEYS[1], window)
+return {allowed, limit - count, retry}`
+
+var (
+	tokenBucket = newScript(tokenBucketScript)
+	slidingLog  = newScript(slidingLogScript)
+)
+
+// script is a Lua script, with its SHA1 for EVALSHA.
+type script struct {
+	src, sha string
+}
+
+func newScript(src string) *script {
+	h := sha1.Sum([]byte(src))
+	return &script{
+		src: src,
+		sha: hex.EncodeToString(h[:]),
+	}
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	// Allowed is whether the request is within the limit.
+	Allowed bool
+	// Remaining is how many more requests are allowed right now.
+	Remaining int
+	// RetryAfter is how long to wait until the request would be allowed. It's
+	// 0 if it's allowed, and -1 if it never will be.
+	RetryAfter time.Duration
+}
+
+// Check is a single rate limit check. Make them with the Check() method of a
+// limiter, and execute them with Exec().
+type Check struct {
+	script *script
+	key    string
+	args   []string
+	cmd    *shredis.Cmd
+	res    []int
+	err    error
+}
+
+// invalidCheck is a check which fails with err, without running anything.
+func invalidCheck(err error) *Check {
+	return &Check{err: err}
+}
+
+func checkN(n int) error {
+	if n < 1 {
+		return fmt.Errorf("ratelimit: invalid n: %d", n)
+	}
+	return nil
+}
+
+func newCheck(s *script, key string, args ...string) *Check {
+	return &Check{
+		script: s,
+		key:    key,
+		args:   args,
+		err:    shredis.ErrNotExecuted,
+	}
+}
+
+// build makes the command for the check, with EVALSHA or EVAL.
+func (c *Check) build(eval, script string) *shredis.Cmd {
+	c.cmd = shredis.Build(c.key, append([]string{eval, script, "1", c.key}, c.args...)...)
+	return c.cmd
+}
+
+// Result gives the outcome of the check, after Exec(). Like the Get*()
+// functions of a shredis.Cmd it can only be called once.
+func (c *Check) Result() (Result, error) {
+	vs, err := c.res, c.err
+	c.res, c.err = nil, shredis.ErrAlreadyGot
+	if err != nil {
+		return Result{}, err
+	}
+	if len(vs) != 3 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected reply: %v", vs)
+	}
+	return Result{
+		Allowed:    vs[0] == 1,
+		Remaining:  vs[1],
+		RetryAfter: retryAfter(vs[2]),
+	}, nil
+}
+
+func retryAfter(ms int) time.Duration {
+	if ms < 0 {
+		return -1
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Exec executes all checks, in a single pipelined shredis Exec(). Checks can
+// come from different limiters. Checks which run into a shard which doesn't
+// know the script yet are sent again with the full script, in a second Exec().
+// Invalid checks (with an n below 1) are not sent, they keep their error.
+func Exec(ctx context.Context, shr *shredis.Shred, checks ...*Check) {
+	var (
+		valid []*Check
+		cmds  []*shredis.Cmd
+	)
+	for _, c := range checks {
+		if c.script == nil {
+			continue
+		}
+		valid = append(valid, c)
+		cmds = append(cmds, c.build("EVALSHA", c.script.sha))
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	shr.ExecMode(ctx, shredis.ReconnectDefault, cmds...)
+
+	var again []*Check
+	cmds = cmds[:0]
+	for _, c := range valid {
+		c.res, c.err = c.cmd.GetInts()
+		if errors.Is(c.err, shredis.ErrNoScript) {
+			again = append(again, c)
+			cmds = append(cmds, c.build("EVAL", c.script.src))
+		}
+	}
+	if len(again) == 0 {
+		return
+	}
+	shr.ExecMode(ctx, shredis.ReconnectDefault, cmds...)
+	for _, c := range again {
+		c.res, c.err = c.cmd.GetInts()
+	}
+}
+
+// TokenBucket allows Rate requests per second on average, with bursts up to
+// Burst requests. Make one with NewTokenBucket().
+type TokenBucket struct {
+	shr   *shredis.Shred
+	rate  float64
+	burst int
+	now   func() time.Time
+}
+
+// NewTokenBucket makes a token bucket limiter. rate is in requests per second,
+// and has to be more than 0. burst has to be at least 1.
+func NewTokenBucket(shr *shredis.Shred, rate float64, burst int) (*TokenBucket, error) {
+	if !(rate > 0) {
+		return nil, fmt.Errorf("ratelimit: invalid rate: %v", rate)
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("ratelimit: invalid burst: %d", burst)
+	}
+	return &TokenBucket{
+		shr:   shr,
+		rate:  rate,
+		burst: burst,
+		now:   time.Now,
+	}, nil
+}
+
+// Check makes a check for `n` requests for `key`, to use with Exec(). n has
+// to be at least 1.
+func (b *TokenBucket) Check(key string, n int) *Check {
+	if err := checkN(n); err != nil {
+		return invalidCheck(err)
+	}
+	return newCheck(tokenBucket, key,
+		strconv.FormatFloat(b.rate, 'g', -1, 64),
+		strconv.Itoa(b.burst),
+		nowMs(b.now()),
+		strconv.Itoa(n),
+	)
+}
+
+// Allow checks a single request for `key`.
+func (b *TokenBucket) Allow(ctx context.Context, key string) (Result, error) {
+	return b.AllowN(ctx, key, 1)
+}
+
+// AllowN checks `n` requests for `key`.
+func (b *TokenBucket) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	c := b.Check(key, n)
+	Exec(ctx, b.shr, c)
+	return c.Result()
+}
+
+// SlidingLog allows Limit requests in every Window. It's exact, but it stores
+// every request. Make one with NewSlidingLog().
+type SlidingLog struct {
+	shr    *shredis.Shred
+	limit  int
+	window time.Duration
+	now    func() time.Time
+}
+
+// NewSlidingLog makes a sliding log limiter. limit has to be at least 1, and
+// window at least a millisecond.
+func NewSlidingLog(shr *shredis.Shred, limit int, window time.Duration) (*SlidingLog, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("ratelimit: invalid limit: %d", limit)
+	}
+	if window < time.Millisecond {
+		return nil, fmt.Errorf("ratelimit: invalid window: %v", window)
+	}
+	return &SlidingLog{
+		shr:    shr,
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}, nil
+}
+
+// Check makes a check for `n` requests for `key`, to use with Exec(). n has
+// to be at least 1.
+func (l *SlidingLog) Check(key string, n int) *Check {
+	if err := checkN(n); err != nil {
+		return invalidCheck(err)
+	}
+	return newCheck(slidingLog, key,
+		strconv.Itoa(l.limit),
+		strconv.FormatInt(int64(l.window/time.Millisecond), 10),
+		nowMs(l.now()),
+		strconv.Itoa(n),
+		randomID(),
+	)
+}
+
+// Allow checks a single request for `key`.
+func (l *SlidingLog) Allow(ctx context.Context, key string) (Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+// AllowN checks `n` requests for `key`.
+func (l *SlidingLog) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	c := l.Check(key, n)
+	Exec(ctx, l.shr, c)
+	return c.Result()
+}
+
+func nowMs(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// randomID makes the members of the sliding log unique.
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,290 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+// clock is a fake time.Now.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func setup(t *testing.T) (*miniredis.Miniredis, *miniredis.Miniredis, *shredis.Shred) {
+	mrs, shards := redistest.Miniredis(t, "shard1", "shard2")
+	return mrs[0], mrs[1], shredis.New(shards)
+}
+
+func TestTokenBucket(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	b, err := NewTokenBucket(shr, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		ctx = context.Background()
+		clk = &clock{t: time.Unix(1500000000, 0)}
+	)
+	b.now = clk.now
+
+	for i := 0; i < 5; i++ {
+		res, err := b.Allow(ctx, "user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := res, (Result{Allowed: true, Remaining: 4 - i}); have != want {
+			t.Fatalf("%d: have %+v, want %+v", i, have, want)
+		}
+	}
+	res, err := b.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: false, RetryAfter: 100 * time.Millisecond}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+
+	// other keys have their own bucket
+	if res, err := b.AllowN(ctx, "user2", 5); err != nil || !res.Allowed {
+		t.Fatalf("have %+v %v, want allowed", res, err)
+	}
+
+	clk.t = clk.t.Add(250 * time.Millisecond)
+	res, err = b.AllowN(ctx, "user1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: true, Remaining: 0}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+
+	// a long wait doesn't give more than burst, so more than burst is never
+	// allowed
+	clk.t = clk.t.Add(time.Hour)
+	res, err = b.AllowN(ctx, "user1", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: false, Remaining: 5, RetryAfter: -1}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+	res, err = b.AllowN(ctx, "user1", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: true, Remaining: 0}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	l, err := NewSlidingLog(shr, 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		ctx   = context.Background()
+		start = time.Unix(1500000000, 0)
+		clk   = &clock{t: start}
+	)
+	l.now = clk.now
+
+	for i := 0; i < 3; i++ {
+		clk.t = start.Add(time.Duration(i) * 100 * time.Millisecond)
+		res, err := l.Allow(ctx, "user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := res, (Result{Allowed: true, Remaining: 2 - i}); have != want {
+			t.Fatalf("%d: have %+v, want %+v", i, have, want)
+		}
+	}
+
+	clk.t = start.Add(300 * time.Millisecond)
+	res, err := l.AllowN(ctx, "user1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: false, RetryAfter: 800 * time.Millisecond}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+
+	res, err = l.AllowN(ctx, "user1", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: false, RetryAfter: -1}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+
+	// the first one fell out of the window
+	clk.t = start.Add(1001 * time.Millisecond)
+	res, err = l.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res, (Result{Allowed: true, Remaining: 0}); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	b, err := NewTokenBucket(shr, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewSlidingLog(shr, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checks []*Check
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user%d", i)
+		checks = append(checks, b.Check("bucket:"+key, 1), l.Check("log:"+key, 1), l.Check("log:"+key, 1))
+	}
+	Exec(context.Background(), shr, checks...)
+	for i, c := range checks {
+		res, err := c.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := res.Allowed, i%3 != 2; have != want {
+			t.Errorf("%d: have %v, want %v", i, have, want)
+		}
+	}
+	if len(mr1.Keys()) == 0 || len(mr2.Keys()) == 0 {
+		t.Errorf("keys not on both shards: %v %v", mr1.Keys(), mr2.Keys())
+	}
+}
+
+func TestInvalidN(t *testing.T) {
+	mr1, mr2, shr := setup(t)
+	defer mr1.Close()
+	defer mr2.Close()
+	defer shr.Close()
+
+	b, err := NewTokenBucket(shr, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewSlidingLog(shr, 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, n := range []int{0, -3} {
+		if _, err := b.AllowN(ctx, "bucket", n); err == nil {
+			t.Errorf("%d: expected an error", n)
+		}
+		if _, err := l.AllowN(ctx, "log", n); err == nil {
+			t.Errorf("%d: expected an error", n)
+		}
+	}
+	if len(mr1.Keys()) != 0 || len(mr2.Keys()) != 0 {
+		t.Errorf("keys were set: %v %v", mr1.Keys(), mr2.Keys())
+	}
+
+	// a bad check in a batch doesn't break the others
+	checks := []*Check{b.Check("bucket", -1), b.Check("bucket", 1)}
+	Exec(ctx, shr, checks...)
+	if _, err := checks[0].Result(); err == nil {
+		t.Errorf("expected an error")
+	}
+	if res, err := checks[1].Result(); err != nil || !res.Allowed {
+		t.Errorf("have %+v %v, want allowed", res, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	shr := shredis.New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	b, err := NewTokenBucket(shr, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// redis doesn't have the script yet: EVALSHA, then EVAL. The count
+	// includes the calls the script makes.
+	n := mr.CommandCount()
+	if res, err := b.Allow(ctx, "user1"); err != nil || !res.Allowed {
+		t.Fatalf("have %+v %v, want allowed", res, err)
+	}
+	first := mr.CommandCount() - n
+
+	load := shredis.Build("", "SCRIPT", "LOAD", tokenBucketScript)
+	shr.Exec(load)
+	if sha, err := load.GetString(); err != nil || sha != tokenBucket.sha {
+		t.Fatalf("have %q %v, want %q", sha, err, tokenBucket.sha)
+	}
+	n = mr.CommandCount()
+	if res, err := b.Allow(ctx, "user1"); err != nil || !res.Allowed {
+		t.Fatalf("have %+v %v, want allowed", res, err)
+	}
+	// only EVALSHA
+	if have, want := mr.CommandCount()-n, first-1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		rate  float64
+		burst int
+	}{
+		{0, 1},
+		{-1, 1},
+		{math.NaN(), 1},
+		{1, 0},
+	} {
+		if _, err := NewTokenBucket(nil, c.rate, c.burst); err == nil {
+			t.Errorf("%v/%d: expected an error", c.rate, c.burst)
+		}
+	}
+	for _, c := range []struct {
+		limit  int
+		window time.Duration
+	}{
+		{0, time.Second},
+		{1, 0},
+		{1, time.Microsecond},
+	} {
+		if _, err := NewSlidingLog(nil, c.limit, c.window); err == nil {
+			t.Errorf("%d/%v: expected an error", c.limit, c.window)
+		}
+	}
+	if _, err := NewSlidingLog(nil, 1, time.Millisecond); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -3,7 +3,7 @@ package shredis
 // All replies are build of the types:
 //   - string
 //   - int
-//   - error
+//   - error (always a *RedisError)
 //   - interface{} arrays of the above types
 
 import (
@@ -102,7 +102,7 @@ func (r *replyReader) error() (error, error) {
 	if err != nil {
 		return nil, err
 	}
-	return errors.New(s), nil
+	return parseRedisError(s), nil
 }
 
 func (r *replyReader) bulk() (interface{}, error) {
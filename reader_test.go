@@ -1,7 +1,6 @@
 package shredis
 
 import (
-	"errors"
 	"reflect"
 	"strings"
 	"testing"
@@ -24,7 +23,7 @@ func TestReader(t *testing.T) {
 		},
 		{
 			payload: "-Error message\r\n",
-			want:    errors.New("Error message"),
+			want:    &RedisError{Prefix: "Error", Message: "message"},
 		},
 		{
 			payload: ":1000\r\n",
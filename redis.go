@@ -1,6 +1,8 @@
 package shredis
 
 import (
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -61,6 +63,298 @@ func BuildHset(key, field, value string) *Cmd {
 	return Build(key, "HSET", key, field, value)
 }
 
+// Builders for common single key commands. Commands which take milliseconds
+// (PEXPIRE, SET PX, PSETEX) take a time.Duration, which is not rounded to
+// seconds. Less than a millisecond is rounded up to 1ms.
+
+// strings
+
+// BuildSetPx builds a SET with PX command
+func BuildSetPx(key, value string, ttl time.Duration) *Cmd {
+	return Build(key, "SET", key, value, "PX", FormatMs(ttl))
+}
+
+// BuildSetNxPx builds a SET with NX and PX command
+func BuildSetNxPx(key, value string, ttl time.Duration) *Cmd {
+	return Build(key, "SET", key, value, "NX", "PX", FormatMs(ttl))
+}
+
+// BuildPsetex builds a PSETEX command
+func BuildPsetex(key, value string, ttl time.Duration) *Cmd {
+	return Build(key, "PSETEX", key, FormatMs(ttl), value)
+}
+
+// BuildGetSet is shorthand for Build(key, "GETSET", key, value)
+func BuildGetSet(key, value string) *Cmd {
+	return Build(key, "GETSET", key, value)
+}
+
+// BuildIncr is shorthand for Build(key, "INCR", key)
+func BuildIncr(key string) *Cmd {
+	return Build(key, "INCR", key)
+}
+
+// BuildIncrBy builds an INCRBY command
+func BuildIncrBy(key string, n int64) *Cmd {
+	return Build(key, "INCRBY", key, strconv.FormatInt(n, 10))
+}
+
+// BuildIncrByFloat builds an INCRBYFLOAT command
+func BuildIncrByFloat(key string, f float64) *Cmd {
+	return Build(key, "INCRBYFLOAT", key, formatFloat(f))
+}
+
+// BuildDecr is shorthand for Build(key, "DECR", key)
+func BuildDecr(key string) *Cmd {
+	return Build(key, "DECR", key)
+}
+
+// BuildDecrBy builds a DECRBY command
+func BuildDecrBy(key string, n int64) *Cmd {
+	return Build(key, "DECRBY", key, strconv.FormatInt(n, 10))
+}
+
+// keys
+
+// BuildExists is shorthand for Build(key, "EXISTS", key)
+func BuildExists(key string) *Cmd {
+	return Build(key, "EXISTS", key)
+}
+
+// BuildPexpire builds a PEXPIRE command
+func BuildPexpire(key string, ttl time.Duration) *Cmd {
+	return Build(key, "PEXPIRE", key, FormatMs(ttl))
+}
+
+// BuildExpireAt builds an EXPIREAT command
+func BuildExpireAt(key string, t time.Time) *Cmd {
+	return Build(key, "EXPIREAT", key, strconv.FormatInt(t.Unix(), 10))
+}
+
+// BuildPexpireAt builds a PEXPIREAT command
+func BuildPexpireAt(key string, t time.Time) *Cmd {
+	return Build(key, "PEXPIREAT", key, strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))
+}
+
+// BuildPersist is shorthand for Build(key, "PERSIST", key)
+func BuildPersist(key string) *Cmd {
+	return Build(key, "PERSIST", key)
+}
+
+// BuildPTTL is shorthand for Build(key, "PTTL", key)
+func BuildPTTL(key string) *Cmd {
+	return Build(key, "PTTL", key)
+}
+
+// hashes
+
+// BuildHmset builds an HMSET command. Fields are sorted.
+func BuildHmset(key string, values map[string]string) *Cmd {
+	fields := make([]string, 0, len(values))
+	for f := range values {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	args := make([]string, 0, 2+2*len(values))
+	args = append(args, "HMSET", key)
+	for _, f := range fields {
+		args = append(args, f, values[f])
+	}
+	return Build(key, args...)
+}
+
+// BuildHmget builds an HMGET command
+func BuildHmget(key string, fields ...string) *Cmd {
+	return Build(key, append([]string{"HMGET", key}, fields...)...)
+}
+
+// BuildHgetall is shorthand for Build(key, "HGETALL", key)
+func BuildHgetall(key string) *Cmd {
+	return Build(key, "HGETALL", key)
+}
+
+// BuildHdel builds an HDEL command
+func BuildHdel(key string, fields ...string) *Cmd {
+	return Build(key, append([]string{"HDEL", key}, fields...)...)
+}
+
+// BuildHexists is shorthand for Build(key, "HEXISTS", key, field)
+func BuildHexists(key, field string) *Cmd {
+	return Build(key, "HEXISTS", key, field)
+}
+
+// BuildHincrBy builds an HINCRBY command
+func BuildHincrBy(key, field string, n int64) *Cmd {
+	return Build(key, "HINCRBY", key, field, strconv.FormatInt(n, 10))
+}
+
+// BuildHincrByFloat builds an HINCRBYFLOAT command
+func BuildHincrByFloat(key, field string, f float64) *Cmd {
+	return Build(key, "HINCRBYFLOAT", key, field, formatFloat(f))
+}
+
+// BuildHlen is shorthand for Build(key, "HLEN", key)
+func BuildHlen(key string) *Cmd {
+	return Build(key, "HLEN", key)
+}
+
+// BuildHkeys is shorthand for Build(key, "HKEYS", key)
+func BuildHkeys(key string) *Cmd {
+	return Build(key, "HKEYS", key)
+}
+
+// lists
+
+// BuildLpush builds an LPUSH command
+func BuildLpush(key string, values ...string) *Cmd {
+	return Build(key, append([]string{"LPUSH", key}, values...)...)
+}
+
+// BuildRpush builds an RPUSH command
+func BuildRpush(key string, values ...string) *Cmd {
+	return Build(key, append([]string{"RPUSH", key}, values...)...)
+}
+
+// BuildLpop is shorthand for Build(key, "LPOP", key)
+func BuildLpop(key string) *Cmd {
+	return Build(key, "LPOP", key)
+}
+
+// BuildRpop is shorthand for Build(key, "RPOP", key)
+func BuildRpop(key string) *Cmd {
+	return Build(key, "RPOP", key)
+}
+
+// BuildLrange builds an LRANGE command
+func BuildLrange(key string, start, stop int) *Cmd {
+	return Build(key, "LRANGE", key, strconv.Itoa(start), strconv.Itoa(stop))
+}
+
+// BuildLtrim builds an LTRIM command
+func BuildLtrim(key string, start, stop int) *Cmd {
+	return Build(key, "LTRIM", key, strconv.Itoa(start), strconv.Itoa(stop))
+}
+
+// BuildLrem builds an LREM command
+func BuildLrem(key string, count int, value string) *Cmd {
+	return Build(key, "LREM", key, strconv.Itoa(count), value)
+}
+
+// BuildLlen is shorthand for Build(key, "LLEN", key)
+func BuildLlen(key string) *Cmd {
+	return Build(key, "LLEN", key)
+}
+
+// sets
+
+// BuildSadd builds an SADD command
+func BuildSadd(key string, members ...string) *Cmd {
+	return Build(key, append([]string{"SADD", key}, members...)...)
+}
+
+// BuildSrem builds an SREM command
+func BuildSrem(key string, members ...string) *Cmd {
+	return Build(key, append([]string{"SREM", key}, members...)...)
+}
+
+// BuildSmembers is shorthand for Build(key, "SMEMBERS", key)
+func BuildSmembers(key string) *Cmd {
+	return Build(key, "SMEMBERS", key)
+}
+
+// BuildSismember is shorthand for Build(key, "SISMEMBER", key, member)
+func BuildSismember(key, member string) *Cmd {
+	return Build(key, "SISMEMBER", key, member)
+}
+
+// BuildScard is shorthand for Build(key, "SCARD", key)
+func BuildScard(key string) *Cmd {
+	return Build(key, "SCARD", key)
+}
+
+// sorted sets
+
+// ZaddOptions are the flags for BuildZadd. GT and LT need redis 6.2.
+type ZaddOptions struct {
+	NX, XX, GT, LT, CH, INCR bool
+}
+
+// BuildZadd builds a ZADD command
+func BuildZadd(key string, opts ZaddOptions, members ...ScoredMember) *Cmd {
+	args := make([]string, 0, 8+2*len(members))
+	args = append(args, "ZADD", key)
+	for _, o := range []struct {
+		set  bool
+		flag string
+	}{
+		{opts.NX, "NX"},
+		{opts.XX, "XX"},
+		{opts.GT, "GT"},
+		{opts.LT, "LT"},
+		{opts.CH, "CH"},
+		{opts.INCR, "INCR"},
+	} {
+		if o.set {
+			args = append(args, o.flag)
+		}
+	}
+	for _, m := range members {
+		args = append(args, formatFloat(m.Score), m.Member)
+	}
+	return Build(key, args...)
+}
+
+// BuildZincrBy builds a ZINCRBY command
+func BuildZincrBy(key string, f float64, member string) *Cmd {
+	return Build(key, "ZINCRBY", key, formatFloat(f), member)
+}
+
+// BuildZrem builds a ZREM command
+func BuildZrem(key string, members ...string) *Cmd {
+	return Build(key, append([]string{"ZREM", key}, members...)...)
+}
+
+// BuildZscore is shorthand for Build(key, "ZSCORE", key, member)
+func BuildZscore(key, member string) *Cmd {
+	return Build(key, "ZSCORE", key, member)
+}
+
+// BuildZcard is shorthand for Build(key, "ZCARD", key)
+func BuildZcard(key string) *Cmd {
+	return Build(key, "ZCARD", key)
+}
+
+// BuildZcount builds a ZCOUNT command. Use math.Inf() for open ranges.
+func BuildZcount(key string, min, max float64) *Cmd {
+	return Build(key, "ZCOUNT", key, formatFloat(min), formatFloat(max))
+}
+
+// BuildZrange builds a ZRANGE command. Use GetScoredMembers() with
+// withScores.
+func BuildZrange(key string, start, stop int, withScores bool) *Cmd {
+	args := []string{"ZRANGE", key, strconv.Itoa(start), strconv.Itoa(stop)}
+	if withScores {
+		args = append(args, "WITHSCORES")
+	}
+	return Build(key, args...)
+}
+
+// BuildZrangeByScore builds a ZRANGEBYSCORE command. Use math.Inf() for open
+// ranges, and GetScoredMembers() with withScores.
+func BuildZrangeByScore(key string, min, max float64, withScores bool) *Cmd {
+	args := []string{"ZRANGEBYSCORE", key, formatFloat(min), formatFloat(max)}
+	if withScores {
+		args = append(args, "WITHSCORES")
+	}
+	return Build(key, args...)
+}
+
+// BuildZremRangeByScore builds a ZREMRANGEBYSCORE command. Use math.Inf() for
+// open ranges.
+func BuildZremRangeByScore(key string, min, max float64) *Cmd {
+	return Build(key, "ZREMRANGEBYSCORE", key, formatFloat(min), formatFloat(max))
+}
+
 // RedisInfoStats represents the [Stats] part of the 'INFO' command.
 type RedisInfoStats struct {
 	TotalConnectionsReceived,
@@ -236,3 +530,26 @@ func parseInfo(s string) map[string]string {
 	}
 	return r
 }
+
+// FormatMs formats a duration in whole milliseconds, for PX and such.
+// Durations below a millisecond are rounded up to 1, since redis takes 0 as an
+// error.
+func FormatMs(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+	if ms == 0 && d > 0 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// formatFloat formats a float how redis likes it, with "+inf" and "-inf".
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
@@ -2,6 +2,7 @@ package shredis
 
 import (
 	"bytes"
+	"math"
 	"testing"
 	"time"
 
@@ -79,6 +80,81 @@ func TestBuilds(t *testing.T) {
 			key:     "aap",
 			payload: []string{"TTL", "aap"},
 		},
+		{
+			have:    BuildSetPx("aap", "noot", 7500*time.Millisecond),
+			key:     "aap",
+			payload: []string{"SET", "aap", "noot", "PX", "7500"},
+		},
+		{
+			have:    BuildPexpire("aap", 1500*time.Millisecond),
+			key:     "aap",
+			payload: []string{"PEXPIRE", "aap", "1500"},
+		},
+		{
+			have:    BuildPsetex("aap", "noot", 10*time.Millisecond),
+			key:     "aap",
+			payload: []string{"PSETEX", "aap", "10", "noot"},
+		},
+		{
+			have:    BuildIncrBy("aap", -3),
+			key:     "aap",
+			payload: []string{"INCRBY", "aap", "-3"},
+		},
+		{
+			have:    BuildHmset("aap", map[string]string{"b": "2", "a": "1"}),
+			key:     "aap",
+			payload: []string{"HMSET", "aap", "a", "1", "b", "2"},
+		},
+		{
+			have:    BuildHincrBy("aap", "noot", 4),
+			key:     "aap",
+			payload: []string{"HINCRBY", "aap", "noot", "4"},
+		},
+		{
+			have:    BuildLpush("aap", "noot", "mies"),
+			key:     "aap",
+			payload: []string{"LPUSH", "aap", "noot", "mies"},
+		},
+		{
+			have:    BuildLrange("aap", 0, -1),
+			key:     "aap",
+			payload: []string{"LRANGE", "aap", "0", "-1"},
+		},
+		{
+			have:    BuildSadd("aap", "noot"),
+			key:     "aap",
+			payload: []string{"SADD", "aap", "noot"},
+		},
+		{
+			have:    BuildSmembers("aap"),
+			key:     "aap",
+			payload: []string{"SMEMBERS", "aap"},
+		},
+		{
+			have:    BuildZadd("aap", ZaddOptions{XX: true, CH: true}, ScoredMember{"noot", 1.5}, ScoredMember{"mies", 2}),
+			key:     "aap",
+			payload: []string{"ZADD", "aap", "XX", "CH", "1.5", "noot", "2", "mies"},
+		},
+		{
+			have:    BuildZrangeByScore("aap", math.Inf(-1), 3.5, true),
+			key:     "aap",
+			payload: []string{"ZRANGEBYSCORE", "aap", "-inf", "3.5", "WITHSCORES"},
+		},
+		{
+			have:    BuildPexpire("aap", 1500*time.Microsecond),
+			key:     "aap",
+			payload: []string{"PEXPIRE", "aap", "1"},
+		},
+		{
+			have:    BuildSetPx("aap", "noot", time.Microsecond),
+			key:     "aap",
+			payload: []string{"SET", "aap", "noot", "PX", "1"},
+		},
+		{
+			have:    BuildPsetex("aap", "noot", 0),
+			key:     "aap",
+			payload: []string{"PSETEX", "aap", "0", "noot"},
+		},
 	} {
 		want := &Cmd{
 			hash:    hashKey(c.key),
@@ -140,3 +216,48 @@ func TestSetNX(t *testing.T) {
 	}
 	shr.Close()
 }
+
+func TestTypedBuilds(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	var (
+		incr   = BuildIncrBy("counter", 5)
+		hincr  = BuildHincrBy("hash", "f", 3)
+		push   = BuildRpush("list", "a", "b", "c")
+		lrange = BuildLrange("list", 0, 1)
+		sadd   = BuildSadd("set", "x", "y")
+		card   = BuildScard("set")
+		zadd   = BuildZadd("zset", ZaddOptions{}, ScoredMember{"one", 1}, ScoredMember{"two", 2.5})
+		zrange = BuildZrangeByScore("zset", 2, math.Inf(1), true)
+		setpx  = BuildSetPx("px", "v", 1500*time.Millisecond)
+	)
+	shr.Exec(incr, hincr, push, lrange, sadd, card, zadd, zrange, setpx)
+
+	if v, err := incr.GetInt(); err != nil || v != 5 {
+		t.Errorf("INCRBY: %v %v", v, err)
+	}
+	if v, err := hincr.GetInt(); err != nil || v != 3 {
+		t.Errorf("HINCRBY: %v %v", v, err)
+	}
+	if v, err := lrange.GetStrings(); err != nil || len(v) != 2 || v[0] != "a" {
+		t.Errorf("LRANGE: %v %v", v, err)
+	}
+	if v, err := card.GetInt(); err != nil || v != 2 {
+		t.Errorf("SCARD: %v %v", v, err)
+	}
+	if v, err := zrange.GetScoredMembers(); err != nil || len(v) != 1 || v[0] != (ScoredMember{"two", 2.5}) {
+		t.Errorf("ZRANGEBYSCORE: %v %v", v, err)
+	}
+	if have, want := mr.TTL("px"), 1500*time.Millisecond; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
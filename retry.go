@@ -0,0 +1,157 @@
+package shredis
+
+import (
+	"context"
+	"time"
+)
+
+// readOnly are the commands which are safe to retry.
+var readOnly = map[string]bool{
+	"BITCOUNT":         true,
+	"BITPOS":           true,
+	"DBSIZE":           true,
+	"DUMP":             true,
+	"ECHO":             true,
+	"EXISTS":           true,
+	"GEODIST":          true,
+	"GEOHASH":          true,
+	"GEOPOS":           true,
+	"GET":              true,
+	"GETBIT":           true,
+	"GETRANGE":         true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"HSTRLEN":          true,
+	"HVALS":            true,
+	"INFO":             true,
+	"LINDEX":           true,
+	"LLEN":             true,
+	"LRANGE":           true,
+	"MGET":             true,
+	"PFCOUNT":          true,
+	"PING":             true,
+	"PTTL":             true,
+	"SCARD":            true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"SRANDMEMBER":      true,
+	"STRLEN":           true,
+	"TTL":              true,
+	"TYPE":             true,
+	"XLEN":             true,
+	"XRANGE":           true,
+	"XREVRANGE":        true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZLEXCOUNT":        true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCORE":           true,
+}
+
+// retryWait is the longest a retry waits for its shard to reconnect.
+const retryWait = 250 * time.Millisecond
+
+// OptionRetry is an option to New. Commands which fail because of a connection
+// problem are executed again, at most `n` times, as long as the context of
+// ExecMode() allows. Before every retry Exec waits for the shard to make a new
+// connection, for at most 250ms (or the max backoff plus a dial, if that's
+// shorter, see OptionBackoff). So while a shard is down an Exec() with
+// retries can block for n times that, also with ReconnectFail.
+// Only read-only commands (GET, HGETALL, ...) are retried, unless they are
+// marked otherwise with Cmd.SetRetry(). Retries are only done by Exec() and
+// ExecMode().
+func OptionRetry(n int) Option {
+	return func(s *Shred) {
+		s.retries = n
+	}
+}
+
+// SetRetry marks whether the command may be retried after a connection
+// problem. By default only read-only commands are. Retrying a command which is
+// not idempotent (INCR, LPUSH, ...) might execute it twice. Returns the
+// command itself. See OptionRetry.
+func (c *Cmd) SetRetry(retry bool) *Cmd {
+	c.retry = retry
+	return c
+}
+
+// retryFailed executes the commands which failed because of a connection
+// problem again, as often as OptionRetry allows. gens are the connects from
+// before the first try.
+func (s *Shred) retryFailed(ctx context.Context, queue bool, cs []*Cmd, gens []int) {
+	for try := 0; try < s.retries && ctx.Err() == nil; try++ {
+		again := retryable(cs)
+		if len(again) == 0 {
+			return
+		}
+		if !s.waitReconnect(ctx, gens, again) {
+			return
+		}
+		gens = s.connGens()
+		s.execSorted(ctx, queue, again)
+		cs = again
+	}
+}
+
+// retryable gives the commands which can be retried.
+func retryable(cs []*Cmd) []*Cmd {
+	var again []*Cmd
+	for _, c := range cs {
+		if c.connErr && c.retry {
+			again = append(again, c)
+		}
+	}
+	return again
+}
+
+// connGens gives the number of connects of every shard.
+func (s *Shred) connGens() []int {
+	gens := make([]int, len(s.shards))
+	for i, sh := range s.shards {
+		gens[i], _ = sh.status.connGen()
+	}
+	return gens
+}
+
+// waitReconnect waits until the shards of cmds have connected again since
+// gens, for at most retryWait, or the max backoff plus a dial if that's
+// shorter. Without that retries would fail right away while the shard is in
+// backoff. It returns false if ctx is done or the Shred is shutting down.
+func (s *Shred) waitReconnect(ctx context.Context, gens []int, cmds []*Cmd) bool {
+	wait := s.backoffMax + connTimeout
+	if wait > retryWait {
+		wait = retryWait
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for _, c := range cmds {
+		st := s.shards[c.slot].status
+		for {
+			gen, connected := st.connGen()
+			if gen > gens[c.slot] {
+				break
+			}
+			select {
+			case <-connected:
+			case <-timeout.C:
+				return true
+			case <-ctx.Done():
+				return false
+			case <-s.closing:
+				return false
+			}
+		}
+	}
+	return true
+}
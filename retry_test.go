@@ -0,0 +1,144 @@
+package shredis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func TestRetry(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Flaky(1))
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	}, OptionRetry(2))
+	defer shr.Close()
+
+	get := BuildGet("foo")
+	shr.Exec(get)
+	v, err := get.GetString()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := v, "bar"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+}
+
+func TestRetryReconnect(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("foo", "bar")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	}, OptionRetry(1), OptionBackoff(10*time.Millisecond, 20*time.Millisecond))
+	defer shr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a round trip, so miniredis knows the connection before it closes it
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// down for many backoffs
+	mr.Close()
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		mr.Restart()
+	}()
+
+	get = BuildGet("foo")
+	shr.ExecMode(ctx, ReconnectFail, get)
+	v, err := get.GetString()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := v, "bar"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+}
+
+func TestRetryDown(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := mr.Addr()
+
+	shr := New(map[string]string{
+		"shard0": addr,
+	}, OptionRetry(3), OptionBackoff(time.Second, 5*time.Second))
+	defer shr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a round trip, so miniredis knows the connection before it closes it
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// stays down, the retries don't wait for the backoff
+	mr.Close()
+	start := time.Now()
+	get = BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if have, max := time.Since(start), 3*retryWait+500*time.Millisecond; have > max {
+		t.Errorf("took %v, want at most %v", have, max)
+	}
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Flaky(1))
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	}, OptionRetry(2))
+	defer shr.Close()
+
+	incr := Build("foo", "INCR", "foo")
+	shr.Exec(incr)
+	if _, err := incr.Get(); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// unless asked
+	incr = Build("foo", "INCR", "foo").SetRetry(true)
+	shr.Exec(incr)
+	if _, err := incr.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRetryDisabled(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Flaky(1))
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	defer shr.Close()
+
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
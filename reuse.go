@@ -0,0 +1,116 @@
+package shredis
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInFlight is returned when a Cmd is reset, rebuilt, or put back in a pool
+// while an Exec() is still busy with it.
+var ErrInFlight = errors.New("command in flight")
+
+// acquire marks the command as in flight. It's false if it already was.
+func (c *Cmd) acquire() bool {
+	return atomic.CompareAndSwapInt32(&c.inFlight, 0, 1)
+}
+
+// release marks the command as done.
+func (c *Cmd) release() {
+	atomic.StoreInt32(&c.inFlight, 0)
+}
+
+// acquireAll marks all commands as in flight, and returns them. Commands which
+// are already in flight in another Exec() are left out, since two Exec()s
+// would write the same result. They keep the result of that other Exec().
+// Commands which could not be built are left out too, they keep their error.
+// The same command more than once in cmds is fine.
+func acquireAll(cmds []*Cmd) []*Cmd {
+	for i, c := range cmds {
+		if c.buildErr == nil && (c.acquire() || contains(cmds[:i], c)) {
+			continue
+		}
+		ok := append([]*Cmd{}, cmds[:i]...)
+		for _, c := range cmds[i+1:] {
+			if c.buildErr == nil && (c.acquire() || contains(ok, c)) {
+				ok = append(ok, c)
+			}
+		}
+		return ok
+	}
+	return cmds
+}
+
+func contains(cmds []*Cmd, c *Cmd) bool {
+	for _, o := range cmds {
+		if o == c {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAll marks all commands as done.
+func releaseAll(cmds []*Cmd) {
+	for _, c := range cmds {
+		c.release()
+	}
+}
+
+// Reset makes the command as new, so it can be executed again with the same
+// key and arguments, and all Get*() work again. It fails with ErrInFlight if
+// the command is still being executed.
+func (c *Cmd) Reset() error {
+	if atomic.LoadInt32(&c.inFlight) != 0 {
+		return ErrInFlight
+	}
+	c.res = nil
+	c.err = ErrNotExecuted
+	if c.buildErr != nil {
+		c.err = c.buildErr
+	}
+	c.connErr = false
+	return nil
+}
+
+// Rebuild is Build(), but it reuses the command and its buffer. It fails with
+// ErrInFlight if the command is still being executed.
+func (c *Cmd) Rebuild(key string, fields ...string) error {
+	if err := c.Reset(); err != nil {
+		return err
+	}
+	c.hash = hashKey(key)
+	c.payload = buildCommand(fields, c.payload[:0])
+	c.fields = nil
+	c.buildErr = nil
+	c.err = ErrNotExecuted
+	c.setKind(fields)
+	return nil
+}
+
+// CmdPool keeps commands for reuse, to save allocations in hot paths. The zero
+// value is ready to use, and it's goroutine-safe.
+type CmdPool struct {
+	p sync.Pool
+}
+
+// Build is Build(), but it takes a command from the pool if there is one.
+func (p *CmdPool) Build(key string, fields ...string) *Cmd {
+	c, ok := p.p.Get().(*Cmd)
+	if !ok {
+		return Build(key, fields...)
+	}
+	c.Rebuild(key, fields...)
+	return c
+}
+
+// Put gives a command back to the pool. Don't use the command after this. It
+// fails with ErrInFlight if the command is still being executed, in which case
+// it's not added.
+func (p *CmdPool) Put(c *Cmd) error {
+	if err := c.Reset(); err != nil {
+		return err
+	}
+	p.p.Put(c)
+	return nil
+}
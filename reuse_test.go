@@ -0,0 +1,176 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func TestReset(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	incr := Build("foo", "INCR", "foo")
+	for i := 1; i < 4; i++ {
+		shr.Exec(incr)
+		v, err := incr.GetInt()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if have, want := v, i; have != want {
+			t.Fatalf("have %d, want %d", have, want)
+		}
+		if _, err := incr.GetInt(); err != ErrAlreadyGot {
+			t.Fatalf("have %v, want %v", err, ErrAlreadyGot)
+		}
+		if err := incr.Reset(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := incr.Get(); err != ErrNotExecuted {
+			t.Fatalf("have %v, want %v", err, ErrNotExecuted)
+		}
+	}
+
+	if err := incr.Rebuild("bar", "SET", "bar", "baz"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	shr.Exec(incr)
+	if _, err := incr.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, _ := mr.Get("bar"); have != "baz" {
+		t.Fatalf("have %q, want %q", have, "baz")
+	}
+}
+
+func TestCmdPool(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("foo", "bar")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	var p CmdPool
+	for i := 0; i < 10; i++ {
+		get := p.Build("foo", "GET", "foo")
+		shr.Exec(get)
+		v, err := get.GetString()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if have, want := v, "bar"; have != want {
+			t.Fatalf("have %q, want %q", have, want)
+		}
+		if err := p.Put(get); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	defer shutdownNow(shr)
+
+	var (
+		p   CmdPool
+		get = p.Build("foo", "GET", "foo")
+	)
+	pending := shr.Go(get)
+	time.Sleep(10 * time.Millisecond)
+
+	if have, want := get.Reset(), ErrInFlight; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	if have, want := get.Rebuild("foo", "GET", "foo"), ErrInFlight; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	if have, want := p.Put(get), ErrInFlight; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	if have, want := shr.ShardExec("shard0", get), ErrInFlight; !errors.Is(have, want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	other := shr.Go(BuildGet("bar"), get)
+
+	shutdownNow(shr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pending.Wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := other.Wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the result of the first Go()
+	if _, have := get.Get(); !errors.Is(have, ErrClosed) {
+		t.Fatalf("have %v, want %v", have, ErrClosed)
+	}
+	if err := get.Reset(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestInFlightBatch(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	pop := Build("list", "BLPOP", "list", "0")
+	pending := shr.Go(pop)
+	time.Sleep(10 * time.Millisecond)
+
+	// the rest of the batch runs
+	set := BuildSet("foo", "bar")
+	shr.Exec(set, pop)
+	if _, err := set.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	push := Build("list", "LPUSH", "list", "v")
+	shr.Exec(push)
+	if _, err := push.Get(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pending.Wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the owner's result is left alone
+	v, err := pop.GetStrings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := v, []string{"list", "v"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+}
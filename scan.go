@@ -0,0 +1,295 @@
+package shredis
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Struct fields are stored in a redis hash with the field name, or the name
+// from a `redis:"name"` tag. Fields tagged `redis:"-"` and unexported fields
+// are skipped. With `redis:"name,omitempty"` BuildHsetStruct skips zero values.
+//
+// Supported field types are strings, []byte, all ints, uints, and floats,
+// bool, and everything which implements encoding.TextMarshaler and
+// encoding.TextUnmarshaler, such as time.Time. Fields of other types (maps,
+// pointers, nested structs, ...) are skipped.
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// structField is a struct field which is stored in a hash field.
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// structFieldCache is reflect.Type -> []structField
+var structFieldCache sync.Map
+
+func structFields(t reflect.Type) []structField {
+	if fs, ok := structFieldCache.Load(t); ok {
+		return fs.([]structField)
+	}
+	var fs []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("redis")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if j := strings.IndexByte(tag, ','); j >= 0 {
+			name, opts = tag[:j], tag[j+1:]
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if !supportedType(f.Type) {
+			continue
+		}
+		fs = append(fs, structField{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	structFieldCache.Store(t, fs)
+	return fs
+}
+
+// supportedType is whether a struct field of type t can be stored.
+func supportedType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Ptr, reflect.Interface:
+		// could be nil
+		return false
+	}
+	return reflect.PtrTo(t).Implements(textMarshalerType)
+}
+
+// structValue gives the struct v is, or points to. It's addressable, so
+// MarshalText() methods on pointers work.
+func structValue(v interface{}) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return rv, false
+	}
+	if !rv.CanAddr() {
+		p := reflect.New(rv.Type()).Elem()
+		p.Set(rv)
+		rv = p
+	}
+	return rv, true
+}
+
+// errCmd is a command which can't be built. Exec() leaves it out, and its
+// Get*() give err.
+func errCmd(err error) *Cmd {
+	return &Cmd{
+		err:      err,
+		buildErr: err,
+	}
+}
+
+// BuildHsetStruct builds an HMSET which stores all fields of the struct v (or
+// the struct v points to) in the hash 'key'. If v is not a struct, if a field
+// can't be marshaled, or if there are no fields to store, the command isn't
+// executed, and it fails with that error.
+func BuildHsetStruct(key string, v interface{}) *Cmd {
+	rv, ok := structValue(v)
+	if !ok {
+		return errCmd(fmt.Errorf("shredis: BuildHsetStruct needs a struct, not %T", v))
+	}
+	fields := []string{"HMSET", key}
+	for _, f := range structFields(rv.Type()) {
+		fv := rv.Field(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		s, err := fieldString(fv)
+		if err != nil {
+			return errCmd(fmt.Errorf("shredis: field %s: %w", f.name, err))
+		}
+		fields = append(fields, f.name, s)
+	}
+	if len(fields) == 2 {
+		return errCmd(errors.New("shredis: BuildHsetStruct: no fields to store"))
+	}
+	return Build(key, fields...)
+}
+
+// BuildHmgetStruct builds an HMGET for all fields of the struct v (or the
+// struct v points to). Use Cmd.Scan() to read the result. If v is not a
+// struct, or if it has no fields, the command isn't executed, and it fails
+// with that error.
+func BuildHmgetStruct(key string, v interface{}) *Cmd {
+	rv, ok := structValue(v)
+	if !ok {
+		return errCmd(fmt.Errorf("shredis: BuildHmgetStruct needs a struct, not %T", v))
+	}
+	var names []string
+	for _, f := range structFields(rv.Type()) {
+		names = append(names, f.name)
+	}
+	if len(names) == 0 {
+		return errCmd(errors.New("shredis: BuildHmgetStruct: no fields"))
+	}
+	c := Build(key, append([]string{"HMGET", key}, names...)...)
+	c.fields = names
+	return c
+}
+
+// Scan copies a hash into the struct dst points to. It works for replies with
+// field/value pairs, such as from HGETALL and HRANDFIELD WITHVALUES, and for
+// commands made with BuildHmgetStruct. Struct fields which are not in the
+// reply are not changed.
+func (c *Cmd) Scan(dst interface{}) error {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Scan needs a pointer to a struct, not %T", dst)
+	}
+	rv = rv.Elem()
+	if c.res == nil {
+		return nil
+	}
+	s, ok := c.res.([]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected value. have %T, want []interface{}", c.res)
+	}
+
+	values := map[string]interface{}{}
+	if c.fields != nil {
+		for i, f := range c.fields {
+			if i < len(s) {
+				values[f] = s[i]
+			}
+		}
+	} else {
+		for len(s) > 1 {
+			k, err := resString(s[0])
+			if err != nil {
+				return err
+			}
+			values[k] = s[1]
+			s = s[2:]
+		}
+	}
+
+	for _, f := range structFields(rv.Type()) {
+		v, ok := values[f.name]
+		if !ok || v == nil {
+			continue
+		}
+		str, err := resString(v)
+		if err != nil {
+			return err
+		}
+		if err := setField(rv.Field(f.index), str); err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+func fieldString(v reflect.Value) (string, error) {
+	if m, ok := textMarshaler(v); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return "1", nil
+		}
+		return "0", nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported type %s", v.Type())
+}
+
+func textMarshaler(v reflect.Value) (encoding.TextMarshaler, bool) {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		return m, true
+	}
+	if v.CanAddr() {
+		m, ok := v.Addr().Interface().(encoding.TextMarshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
+func setField(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		v.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
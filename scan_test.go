@@ -0,0 +1,236 @@
+package shredis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+type upper string
+
+func (u *upper) UnmarshalText(b []byte) error {
+	*u = upper(strings.ToUpper(string(b)))
+	return nil
+}
+
+type scanStruct struct {
+	Name    string    `redis:"name"`
+	Age     int       `redis:"age"`
+	Score   float64   `redis:"score"`
+	Admin   bool      `redis:"admin"`
+	Created time.Time `redis:"created"`
+	Blob    []byte    `redis:"blob"`
+	Shout   upper     `redis:"shout"`
+	Count   uint16
+	Empty   string `redis:"empty,omitempty"`
+	Skip    string `redis:"-"`
+	skip    string
+}
+
+func TestScan(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	in := scanStruct{
+		Name:    "aap",
+		Age:     42,
+		Score:   3.14,
+		Admin:   true,
+		Created: time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC),
+		Blob:    []byte{0, 1, 2},
+		Shout:   "noot",
+		Count:   7,
+		Skip:    "skip",
+		skip:    "skip",
+	}
+	set := BuildHsetStruct("h", &in)
+	shr.Exec(set)
+	if _, err := set.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, _ := mr.HKeys("h")
+	if have, want := len(keys), 8; have != want {
+		t.Fatalf("have %v, want %v: %v", have, want, keys)
+	}
+	if have, want := mr.HGet("h", "admin"), "1"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+
+	check := func(out scanStruct) {
+		t.Helper()
+		if have, want := out.Name, "aap"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+		if have, want := out.Age, 42; have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+		if have, want := out.Score, 3.14; have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+		if !out.Admin {
+			t.Errorf("Admin not set")
+		}
+		if have, want := out.Created, in.Created; !have.Equal(want) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+		if have, want := out.Blob, in.Blob; !bytes.Equal(have, want) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+		if have, want := out.Shout, upper("NOOT"); have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+		if have, want := out.Count, uint16(7); have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+		if out.Skip != "" || out.skip != "" {
+			t.Errorf("skipped fields are set")
+		}
+	}
+
+	{
+		all := Build("h", "HGETALL", "h")
+		shr.Exec(all)
+		var out scanStruct
+		if err := all.Scan(&out); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		check(out)
+	}
+
+	{
+		get := BuildHmgetStruct("h", scanStruct{})
+		shr.Exec(get)
+		out := scanStruct{Empty: "untouched"}
+		if err := get.Scan(&out); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		check(out)
+		if have, want := out.Empty, "untouched"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.HSet("h", "age", "old")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	{
+		all := Build("h", "HGETALL", "h")
+		shr.Exec(all)
+		var out scanStruct
+		err := all.Scan(&out)
+		if err == nil || !strings.HasPrefix(err.Error(), "field age: ") {
+			t.Fatalf("have %v, want a field error", err)
+		}
+	}
+
+	{
+		all := Build("h", "HGETALL", "h")
+		shr.Exec(all)
+		if err := all.Scan(scanStruct{}); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	{
+		get := BuildGet("h")
+		if err := get.Scan(&scanStruct{}); err != ErrNotExecuted {
+			t.Fatalf("have %v, want %v", err, ErrNotExecuted)
+		}
+	}
+}
+
+type Embedded struct {
+	Inner string
+}
+
+type oddStruct struct {
+	Embedded
+	Name   string            `redis:"name"`
+	Tags   map[string]string `redis:"tags"`
+	When   *time.Time        `redis:"when"`
+	Nested struct{ A int }   `redis:"nested"`
+	Any    interface{}       `redis:"any"`
+}
+
+func TestBuildStructErrors(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	// unsupported fields are skipped
+	set := BuildHsetStruct("h", oddStruct{Name: "aap"})
+	shr.Exec(set)
+	if _, err := set.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := mr.HGet("h", "name"), "aap"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+	for _, f := range []string{"Embedded", "Inner", "tags", "when", "nested", "any"} {
+		if have := mr.HGet("h", f); have != "" {
+			t.Errorf("%s: have %q", f, have)
+		}
+	}
+	get := BuildHmgetStruct("h", &oddStruct{})
+	shr.Exec(get)
+	var out oddStruct
+	if err := get.Scan(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := out.Name, "aap"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+
+	// these are never sent
+	for _, c := range []*Cmd{
+		BuildHsetStruct("h", 42),
+		BuildHmgetStruct("h", "foo"),
+		BuildHsetStruct("h", struct {
+			Empty string `redis:"empty,omitempty"`
+		}{}),
+		BuildHmgetStruct("h", struct{ m map[string]int }{}),
+	} {
+		shr.Exec(c)
+		if _, err := c.Get(); err == nil || err == ErrNotExecuted {
+			t.Errorf("have %v, want a build error", err)
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if err := shr.ShardExec("shard0", c); err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+	if have, want := len(mr.Keys()), 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+}
@@ -12,6 +12,8 @@
 package shredis
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"sort"
@@ -22,20 +24,73 @@ import (
 const (
 	// timeout is the dial, read, and write timeout.
 	connTimeout = 1 * time.Second
+	// defaultQueueSize is the number of commands held per shard during a
+	// reconnect, if ReconnectQueue is used without OptionReconnectQueue.
+	defaultQueueSize = 1000
+)
+
+// ErrClosed is the error for commands which are executed after Close() or
+// Shutdown(), or which couldn't finish before the Shutdown() deadline.
+var ErrClosed = errors.New("closed")
+
+// ReconnectMode decides what happens to commands for a shard which is
+// reconnecting.
+type ReconnectMode int
+
+const (
+	// ReconnectDefault uses the mode of the Shred. That's ReconnectFail,
+	// unless OptionReconnectQueue is used.
+	ReconnectDefault ReconnectMode = iota
+	// ReconnectFail fails commands right away with the connection error.
+	ReconnectFail
+	// ReconnectQueue holds commands until the connection is back, and sends
+	// them then. Commands fail if the queue is full, or when the context is
+	// done.
+	ReconnectQueue
 )
 
 // LogCB is optional callback to monitor batch performance. t is the time from
 // the first write to the last receive of a batch, and is only non-zero on
-// successful complete batch execution.
+// successful complete batch execution. With OptionBatchLimits it's called for
+// every round.
 type LogCB func(servername string, batchSize int, t time.Duration, err error)
 
 // Shred controls all connections. Make one with New().
 type Shred struct {
-	ket       continuum
-	shards    []shard
-	onConnect []*Cmd
-	connwg    sync.WaitGroup
-	logCB     LogCB
+	ket         continuum
+	shards      []shard
+	onConnect   []*Cmd
+	connwg      sync.WaitGroup
+	logCB       LogCB
+	eventCB     EventCB
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	queue       bool
+	queueSize   int
+	healthCheck time.Duration
+	preconnect  bool
+	quorum      int
+	preTimeout  time.Duration
+	retries     int
+	breaker     *BreakerConfig
+	queueDepth  int
+	overflow    OverflowPolicy
+	// overflowTimeout is used with OverflowTimeout.
+	overflowTimeout time.Duration
+	maxCmds         int
+	maxBytes        int
+	poolSize        int
+	nearCache       *NearCacheConfig
+	// near is set with OptionNearCache.
+	near *nearCache
+	// mu protects closed. It's read-locked while sending to a conn.
+	mu        sync.RWMutex
+	closed    bool
+	abort     chan struct{}
+	abortOnce sync.Once
+	// closing is closed as soon as Shutdown() is called.
+	closing     chan struct{}
+	closingOnce sync.Once
 }
 
 // Option is an option to New.
@@ -44,9 +99,17 @@ type Option func(*Shred)
 type shard struct {
 	label, addr string
 	conn        conn
+	status      *shardStatus
+	breaker     *breaker
+	// pool has the dedicated connections, for blocking commands.
+	pool *connPool
 }
 
-// OptionAuth is an option to New. It supports the redis AUTH command.
+// OptionAuth is an option to New. It supports the redis AUTH command. An error
+// reply to the AUTH (a wrong password) fails the handshake: the connection is
+// closed and retried with backoff, with an EventHandshakeFailed every time,
+// and commands for the shard fail until it works. An AUTH to a server without
+// a password is not an error.
 func OptionAuth(pw string) Option {
 	return func(s *Shred) {
 		s.onConnect = append(s.onConnect, Build("", "AUTH", pw))
@@ -61,76 +124,349 @@ func OptionLog(l LogCB) Option {
 	}
 }
 
+// OptionEvents is an option to New. It adds a callback which is executed on
+// every connection state change of every shard.
+func OptionEvents(e EventCB) Option {
+	return func(s *Shred) {
+		s.eventCB = e
+	}
+}
+
+// OptionBackoff is an option to New. After a failed connection attempt Shredis
+// waits before it tries again, starting at `min` and doubling up to `max`, with
+// some random jitter. The wait starts at `min` again after a successful
+// connect. Commands for a shard which is waiting fail right away, unless they
+// are queued (see ReconnectMode). The default is 50ms to 5s.
+func OptionBackoff(min, max time.Duration) Option {
+	return func(s *Shred) {
+		s.backoffMin = min
+		s.backoffMax = max
+	}
+}
+
+// OptionReconnectQueue is an option to New. It makes ReconnectQueue the default
+// mode: commands for a shard which is reconnecting are held, and sent once the
+// connection is back. At most `size` commands are held per shard, commands over
+// that fail right away.
+func OptionReconnectQueue(size int) Option {
+	return func(s *Shred) {
+		s.queue = true
+		s.queueSize = size
+	}
+}
+
+// OptionHealthCheck is an option to New. It sends a PING on every connection
+// which has been idle for `d`, so broken connections are found before a real
+// command hits them. The results are visible in Status().
+func OptionHealthCheck(d time.Duration) Option {
+	return func(s *Shred) {
+		s.healthCheck = d
+	}
+}
+
+// OptionBatchLimits is an option to New. Shredis sends all commands which are
+// waiting for a shard in a single batch. With this option the batch is split
+// into rounds of at most `maxCmds` commands and `maxBytes` bytes, which are
+// written and read before the next round is sent. A command bigger than
+// maxBytes gets a round of its own. 0 is no limit.
+func OptionBatchLimits(maxCmds, maxBytes int) Option {
+	return func(s *Shred) {
+		s.maxCmds = maxCmds
+		s.maxBytes = maxBytes
+	}
+}
+
+// OptionPreconnect is an option to NewShred. NewShred will block until `quorum`
+// shards have connected, or give an error after `timeout`. A quorum of 0
+// means all shards. New() ignores this option, use WaitReady() there.
+func OptionPreconnect(quorum int, timeout time.Duration) Option {
+	return func(s *Shred) {
+		s.preconnect = true
+		s.quorum = quorum
+		s.preTimeout = timeout
+	}
+}
+
+// NewShred is New, but it checks the configuration first, and it can wait for
+// the connections to be made with OptionPreconnect.
+func NewShred(cfg Config) (*Shred, error) {
+	s := newShred(cfg.Options)
+	if err := s.validate(cfg); err != nil {
+		return nil, err
+	}
+	s.start(cfg.Shards, cfg.Weights)
+
+	if s.preconnect {
+		n := s.quorum
+		if n == 0 {
+			n = len(s.shards)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.preTimeout)
+		defer cancel()
+		if err := s.waitReady(ctx, n); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
 // New starts all connections to redis daemons. `shards` is a map with
-// shardname:address.
+// shardname:address. New doesn't wait for the connections, and it ignores
+// OptionPreconnect. Use NewShred() or WaitReady() for that.
 func New(shards map[string]string, options ...Option) *Shred {
+	s := newShred(options)
+	s.start(shards, nil)
+	return s
+}
+
+// newShred makes a Shred with all options applied, but without connections.
+func newShred(options []Option) *Shred {
 	s := &Shred{
-		shards: make([]shard, len(shards)),
-		logCB:  func(string, int, time.Duration, error) {},
+		logCB:      func(string, int, time.Duration, error) {},
+		eventCB:    func(Event) {},
+		backoffMin: defaultBackoffMin,
+		backoffMax: defaultBackoffMax,
+		queueSize:  defaultQueueSize,
+		queueDepth: defaultQueueDepth,
+		poolSize:   defaultPoolSize,
+		abort:      make(chan struct{}),
+		closing:    make(chan struct{}),
 	}
 	for _, o := range options {
 		o(s)
 	}
+	return s
+}
 
+// start starts all connections. Shards without a weight get weight 1.
+func (s *Shred) start(shards map[string]string, weights map[string]int) {
+	s.shards = make([]shard, len(shards))
+	if s.nearCache != nil {
+		s.near = newNearCache(*s.nearCache, len(shards))
+		// With hits from the cache the normal connection can be idle for
+		// long. If redis drops it the tracking is gone too, and we need to
+		// know.
+		if s.healthCheck == 0 || s.healthCheck > trackPing {
+			s.healthCheck = trackPing
+		}
+	}
 	var (
 		bs []bucket
 		i  = 0
 	)
 	for l, h := range shards {
-		bs = append(bs, bucket{Label: l, ID: i, Weight: 1})
+		w, ok := weights[l]
+		if !ok {
+			w = 1
+		}
+		bs = append(bs, bucket{Label: l, ID: i, Weight: w})
 		s.connwg.Add(1)
-		c := newConn()
-		go func(l, h string) {
-			c.handle(h, l, s.onConnect, s.logCB)
+		c := newConn(s.queueDepth)
+		b := newBackoff(s.backoffMin, s.backoffMax)
+		st := newShardStatus(l, h)
+		br := newBreaker(s.breaker, breakerEvents(l, h, s.eventCB))
+		go func(i int, l, h string) {
+			c.handle(connOpts{
+				addr:        h,
+				label:       l,
+				onConnect:   s.onConnect,
+				log:         s.logCB,
+				events:      s.eventCB,
+				backoff:     b,
+				queueSize:   s.queueSize,
+				healthCheck: s.healthCheck,
+				status:      st,
+				abort:       s.abort,
+				breaker:     br,
+				maxCmds:     s.maxCmds,
+				maxBytes:    s.maxBytes,
+				near:        s.near,
+				slot:        i,
+			})
 			s.connwg.Done()
-		}(l, h)
+		}(i, l, h)
 		s.shards[i] = shard{
-			conn:  c,
-			label: l,
-			addr:  h,
+			conn:    c,
+			label:   l,
+			addr:    h,
+			status:  st,
+			breaker: br,
+			pool:    newConnPool(h, s.poolSize, s.dial),
 		}
 		i++
 	}
 	s.ket = ketamaNew(bs)
-	return s
+	if s.near != nil {
+		for i := range s.shards {
+			s.connwg.Add(1)
+			go s.track(i)
+		}
+	}
 }
 
-// Close closes all connections. Blocks.
+// Close closes all connections. Blocks until all commands are done.
 func (s *Shred) Close() {
-	for _, sh := range s.shards {
-		sh.conn.close()
+	s.Shutdown(context.Background())
+}
+
+// Shutdown closes all connections. New commands fail with ErrClosed right
+// away. Commands which are already sent get until ctx is done to finish, after
+// that they fail with ErrClosed, and Shutdown returns ctx's error. Blocks until
+// all connections are closed.
+func (s *Shred) Shutdown(ctx context.Context) error {
+	// releases Exec()s waiting for a full queue
+	s.closingOnce.Do(func() { close(s.closing) })
+
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, sh := range s.shards {
+			sh.conn.close()
+			sh.pool.close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connwg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.abortOnce.Do(func() { close(s.abort) })
+		<-done
+		return ctx.Err()
 	}
-	s.connwg.Wait()
 }
 
-// Exec is the way to execute commands. It is goroutine-safe.
+// exec sends an action to a shard. After Close() the action fails with
+// ErrClosed. The read lock is held during the send, so Shutdown() can't close
+// the conn under us, but a send which waits for room also gives up as soon as
+// Shutdown() closes s.closing, which it does before it takes the lock.
+func (s *Shred) exec(sh shard, a action) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		a.doneError(ErrClosed)
+		return
+	}
+	ok, probe := sh.breaker.allow()
+	if !ok {
+		a.doneError(ErrCircuitOpen)
+		return
+	}
+	a.probe = probe
+	if !s.send(sh.conn, a) {
+		sh.breaker.cancel(probe)
+	}
+}
+
+// Exec is the way to execute commands. It is goroutine-safe, but a Cmd can
+// only be in a single Exec() at a time. A Cmd which is already in another
+// Exec() is left out, and it keeps the result of that other Exec(). The rest of
+// the commands run as usual. Use ShardExec() to get ErrInFlight instead.
+// With OptionRetry it can block while a shard reconnects, see there.
 func (s *Shred) Exec(cmds ...*Cmd) {
-	var wg = sync.WaitGroup{}
+	s.ExecMode(context.Background(), ReconnectDefault, cmds...)
+}
 
+// ExecMode is Exec, with the reconnect mode for this call. Commands which are
+// held during a reconnect fail when ctx is done, and no more retries are done
+// after that (see OptionRetry). Commands which wait for room in a full queue
+// also fail when ctx is done (see OptionOverflow), and so do blocking commands
+// (see OptionPoolSize).
+func (s *Shred) ExecMode(ctx context.Context, mode ReconnectMode, cmds ...*Cmd) {
 	if len(cmds) == 0 {
 		return
 	}
 
+	queue := s.queue
+	switch mode {
+	case ReconnectFail:
+		queue = false
+	case ReconnectQueue:
+		queue = true
+	}
+
+	cmds = acquireAll(cmds)
+	defer releaseAll(cmds)
+
+	normal, blocking := splitBlocking(cmds)
+	if len(blocking) > 0 {
+		done := make(chan struct{})
+		go func() {
+			s.execBlocking(ctx, blocking)
+			close(done)
+		}()
+		defer func() { <-done }()
+	}
+	if s.near != nil {
+		var fills []nearFill
+		normal, fills = s.near.get(s.ket, normal)
+		defer s.near.fill(fills)
+	}
+	if len(normal) == 0 {
+		return
+	}
+
+	cs := s.sortedCmds(normal)
+	var gens []int
+	if s.retries > 0 {
+		gens = s.connGens()
+	}
+	s.execSorted(ctx, queue, cs)
+	s.retryFailed(ctx, queue, cs, gens)
+}
+
+// sortedCmds gives the commands sorted by slot, with the slot set.
+func (s *Shred) sortedCmds(cmds []*Cmd) []*Cmd {
 	cs := make([]*Cmd, len(cmds))
 	copy(cs, cmds)
 	for _, c := range cs {
 		c.slot = s.ket.Slot(c.hash)
 	}
 	sort.Stable(cmdsBySlot(cs))
+	return cs
+}
+
+// execSorted executes commands which are sorted by slot, and waits for them.
+func (s *Shred) execSorted(ctx context.Context, queue bool, cs []*Cmd) {
+	var wg = sync.WaitGroup{}
+	wg.Add(countSlots(cs))
+	s.sendSorted(ctx, queue, cs, &wg)
+	wg.Wait()
+}
 
-	// Collect all actions per connection, and execute them at the same time.
+// sendSorted sends commands which are sorted by slot, with a single action per
+// connection. It doesn't wait, wg is told when every action is done.
+func (s *Shred) sendSorted(ctx context.Context, queue bool, cs []*Cmd, wg doner) {
 	for i, j := 0, 1; j <= len(cs); j++ {
 		if j == len(cs) || cs[j].slot != cs[i].slot {
-			wg.Add(1)
-			s.shards[cs[i].slot].conn.exec(action{
-				cmds: cs[i:j],
-				wg:   &wg,
+			s.exec(s.shards[cs[i].slot], action{
+				cmds:  cs[i:j],
+				wg:    wg,
+				queue: queue,
+				ctx:   ctx,
 			})
 			i = j
 		}
 	}
+}
 
-	wg.Wait()
+// countSlots gives the number of different slots of commands which are sorted
+// by slot.
+func countSlots(cs []*Cmd) int {
+	n := 0
+	for i := range cs {
+		if i == 0 || cs[i].slot != cs[i-1].slot {
+			n++
+		}
+	}
+	return n
 }
 
 // MapExec builds a command of `fields` and sends it to every redis. It returns
@@ -141,15 +477,16 @@ func (s *Shred) MapExec(fields ...string) map[string]*Cmd {
 		cmds = map[string]*Cmd{}
 	)
 
-	for _, shard := range s.shards {
+	for i, shard := range s.shards {
 		cmd := &Cmd{
 			// no key
 			payload: buildCommand(fields, nil),
 			err:     ErrNotExecuted,
 		}
 		cmds[shard.label] = cmd
+		s.near.dropWrites(i, cmd)
 		wg.Add(1)
-		shard.conn.exec(action{
+		s.exec(shard, action{
 			cmds: []*Cmd{cmd},
 			wg:   &wg,
 		})
@@ -161,16 +498,24 @@ func (s *Shred) MapExec(fields ...string) map[string]*Cmd {
 }
 
 // RandExec executes the given command on a randomly picked server. It returns
-// the shardname and address of the selected server.
+// the shardname and address of the selected server, or two empty strings if
+// cmd is in flight in another Exec(), or could not be built.
 // You need to seed the random function once.
 func (s *Shred) RandExec(cmd *Cmd) (string, string) {
 	var (
 		wg    = sync.WaitGroup{}
-		shard = s.shards[rand.Intn(len(s.shards))]
+		slot  = rand.Intn(len(s.shards))
+		shard = s.shards[slot]
 	)
+	cmds := acquireAll([]*Cmd{cmd})
+	if len(cmds) == 0 {
+		return "", ""
+	}
+	defer releaseAll(cmds)
+	s.near.dropWrites(slot, cmd)
 
 	wg.Add(1)
-	shard.conn.exec(action{
+	s.exec(shard, action{
 		cmds: []*Cmd{cmd},
 		wg:   &wg,
 	})
@@ -178,22 +523,36 @@ func (s *Shred) RandExec(cmd *Cmd) (string, string) {
 	return shard.label, shard.addr
 }
 
-// ShardExec executes the given command on a specific server.
+// ShardExec executes the given command on a specific server. It fails with
+// ErrInFlight if cmd is in another Exec(), and with the error of cmd if it
+// could not be built.
 func (s *Shred) ShardExec(label string, cmd *Cmd) error {
-	var sh *shard
-	for _, si := range s.shards {
+	var (
+		sh   *shard
+		slot int
+	)
+	for i, si := range s.shards {
 		if si.label == label {
-			sh = &si
+			sh, slot = &si, i
 			break
 		}
 	}
 	if sh == nil {
 		return fmt.Errorf("unknown shard: %s", label)
 	}
+	if cmd.buildErr != nil {
+		return cmd.buildErr
+	}
+	cmds := acquireAll([]*Cmd{cmd})
+	if len(cmds) == 0 {
+		return fmt.Errorf("shredis: %w", ErrInFlight)
+	}
+	defer releaseAll(cmds)
+	s.near.dropWrites(slot, cmd)
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	sh.conn.exec(action{
+	s.exec(*sh, action{
 		cmds: []*Cmd{cmd},
 		wg:   &wg,
 	})
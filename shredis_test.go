@@ -1,12 +1,15 @@
 package shredis
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/alicebob/shredis/internal/redistest"
 )
 
 func TestBasic(t *testing.T) {
@@ -225,6 +228,48 @@ func TestAuth(t *testing.T) {
 	shr.Close()
 }
 
+func TestAuthWrongPassword(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.RequireAuth("secret!")
+
+	events := make(chan Event, 100)
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	},
+		OptionAuth("wrong"),
+		OptionEvents(func(e Event) {
+			select {
+			case events <- e:
+			default:
+			}
+		}),
+	)
+	defer shr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err == nil {
+		t.Fatalf("expected an error")
+	}
+	get := BuildGet("TestKey")
+	shr.Exec(get)
+	if _, err := get.Get(); !errors.Is(err, ErrErr) {
+		t.Fatalf("have %v, want %v", err, ErrErr)
+	}
+	for e := range events {
+		if e.Type == EventHandshakeFailed {
+			if !errors.Is(e.Err, ErrErr) {
+				t.Fatalf("have %v, want %v", e.Err, ErrErr)
+			}
+			break
+		}
+	}
+}
+
 func TestReconnect(t *testing.T) {
 	mr, err := miniredis.Run()
 	if err != nil {
@@ -235,7 +280,7 @@ func TestReconnect(t *testing.T) {
 
 	shr := New(map[string]string{
 		"shard0": mr.Addr(),
-	})
+	}, OptionBackoff(50*time.Millisecond, 50*time.Millisecond))
 	defer shr.Close()
 
 	mr.Close()
@@ -467,3 +512,344 @@ func TestStable(t *testing.T) {
 		}
 	}
 }
+
+func TestEvents(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	addr := mr.Addr()
+
+	events := make(chan Event, 100)
+	shr := New(map[string]string{
+		"shard0": addr,
+	}, OptionEvents(func(e Event) {
+		events <- e
+	}))
+
+	next := func(want EventType) Event {
+		select {
+		case e := <-events:
+			if have := e.Type; have != want {
+				t.Fatalf("have %s, want %s", have, want)
+			}
+			if have, want := e.Label, "shard0"; have != want {
+				t.Fatalf("have %s, want %s", have, want)
+			}
+			if have, want := e.Addr, addr; have != want {
+				t.Fatalf("have %s, want %s", have, want)
+			}
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", want)
+		}
+		return Event{}
+	}
+
+	next(EventDial)
+	next(EventConnected)
+	// a round trip, so miniredis knows the connection before it closes it
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.Close()
+	shr.Exec(BuildGet("foo"))
+	if e := next(EventDisconnected); e.Err == nil {
+		t.Fatalf("expected an error")
+	}
+	next(EventDial)
+	if e := next(EventDialFailed); e.Err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	shr.Close()
+	for e := range events {
+		if e.Type == EventClosed {
+			break
+		}
+	}
+}
+
+func TestReconnectQueue(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.Set("TestKey", "Value!")
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	},
+		OptionBackoff(10*time.Millisecond, 10*time.Millisecond),
+		OptionReconnectQueue(2),
+	)
+	defer shr.Close()
+
+	mr.Close()
+	// notice the connection is gone
+	shr.ExecMode(context.Background(), ReconnectFail, BuildGet("TestKey"))
+
+	// too much for the queue
+	{
+		a, b, c := BuildGet("TestKey"), BuildGet("TestKey"), BuildGet("TestKey")
+		shr.Exec(a, b, c)
+		if _, err := a.Get(); err == nil {
+			t.Fatalf("expected an error")
+		}
+	}
+
+	// held until the context is done
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		get := BuildGet("TestKey")
+		shr.ExecMode(ctx, ReconnectDefault, get)
+		_, err := get.Get()
+		if have, want := err, "shredis: context deadline exceeded"; have == nil || have.Error() != want {
+			t.Fatalf("have %v, want %v", have, want)
+		}
+	}
+
+	// not held when asked
+	{
+		get := BuildGet("TestKey")
+		n := time.Now()
+		shr.ExecMode(context.Background(), ReconnectFail, get)
+		if _, err := get.Get(); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if d := time.Since(n); d > 10*time.Millisecond {
+			t.Fatalf("reply took too long: %s", d)
+		}
+	}
+
+	// held until the connection is back
+	{
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			mr.Restart()
+		}()
+		get := BuildGet("TestKey")
+		shr.Exec(get)
+		v, err := get.GetString()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if have, want := v, "Value!"; have != want {
+			t.Fatalf("have %q, want %q", have, want)
+		}
+	}
+}
+
+func TestPreconnect(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr, err := NewShred(Config{
+		Shards: map[string]string{
+			"shard0": mr.Addr(),
+		},
+		Options: []Option{OptionPreconnect(0, time.Second)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer shr.Close()
+	if !shr.Status()[0].Connected {
+		t.Fatalf("not connected")
+	}
+
+	cfg := Config{
+		Shards: map[string]string{
+			"shard0": mr.Addr(),
+			"shard1": "localhost:1",
+		},
+		Options: []Option{OptionPreconnect(0, 50*time.Millisecond)},
+	}
+	if _, err := NewShred(cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// a quorum is enough
+	cfg.Options = []Option{OptionPreconnect(1, time.Second)}
+	shr2, err := NewShred(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	shr2.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+
+	// Exec()s during and after a Close() don't panic.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				shr.Exec(BuildSet("foo", "bar"))
+			}
+		}()
+	}
+	shr.Close()
+	wg.Wait()
+
+	get := BuildGet("foo")
+	shr.Exec(get)
+	if _, err := get.Get(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v, want %v", err, ErrClosed)
+	}
+	shr.Close()
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// a server which never replies
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	get := BuildGet("foo")
+	done := make(chan struct{})
+	go func() {
+		shr.Exec(get)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if have, want := shr.Shutdown(ctx), context.DeadlineExceeded; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	<-done
+	if _, err := get.Get(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	var (
+		mu      sync.Mutex
+		batches []int
+	)
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	},
+		OptionBatchLimits(3, 0),
+		OptionLog(func(_ string, n int, _ time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			batches = append(batches, n)
+		}),
+	)
+	defer shr.Close()
+
+	var cmds []*Cmd
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("key%d", i)
+		cmds = append(cmds, BuildSet(key, key))
+	}
+	shr.Exec(cmds...)
+	for _, c := range cmds {
+		if _, err := c.Get(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	mu.Lock()
+	if have, want := len(batches), 3; have != want {
+		t.Fatalf("have %d rounds, want %d", have, want)
+	}
+	mu.Unlock()
+
+	// bytes
+	shr2 := New(map[string]string{
+		"shard0": mr.Addr(),
+	}, OptionBatchLimits(0, 40))
+	defer shr2.Close()
+	a, b := BuildSet("aap", "noot"), BuildGet("aap")
+	shr2.Exec(a, b)
+	if v, err := b.GetString(); err != nil || v != "noot" {
+		t.Fatalf("have %q %v, want %q", v, err, "noot")
+	}
+}
+
+func TestShutdownFullQueue(t *testing.T) {
+	l := redistest.NewServer(t, redistest.Silent)
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	}, OptionQueueDepth(1))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// one on the wire, one in the queue, and the rest wait for room.
+	var (
+		wg   sync.WaitGroup
+		gets []*Cmd
+	)
+	for i := 0; i < 4; i++ {
+		get := BuildGet("foo")
+		gets = append(gets, get)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shr.Exec(get)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if have, want := shr.Shutdown(ctx), context.DeadlineExceeded; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("Shutdown took %s", d)
+	}
+	wg.Wait()
+	for _, get := range gets {
+		if _, err := get.Get(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("have %v, want %v", err, ErrClosed)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package shredis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShardStatus is the state of a single shard. See Shred.Status().
+type ShardStatus struct {
+	Label, Addr string
+	// Connected is whether there is a working connection.
+	Connected bool
+	// LastError is the last connection or health check error. It's not
+	// cleared on success, compare LastErrorTime and LastSuccess for that.
+	LastError     error
+	LastErrorTime time.Time
+	// LastSuccess is when the last batch (or health check) got all its
+	// replies.
+	LastSuccess time.Time
+	// RTT is the round trip time of the last health check PING. It's 0
+	// without OptionHealthCheck.
+	RTT time.Duration
+	// Breaker is the state of the circuit breaker. It's always BreakerClosed
+	// without OptionBreaker.
+	Breaker BreakerState
+	// QueueDepth is the number of Exec() batches waiting for the connection.
+	QueueDepth int
+	// Tracking is whether the near cache has invalidation tracking for the
+	// shard, and so caches its replies. It's always false without
+	// OptionNearCache.
+	Tracking bool
+}
+
+// shardStatus is the goroutine safe ShardStatus of a connection.
+type shardStatus struct {
+	mu sync.Mutex
+	s  ShardStatus
+	// ready is closed after the first successful connect.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// gen counts the connects. connected is closed and replaced on every
+	// connect.
+	gen       int
+	connected chan struct{}
+}
+
+func newShardStatus(label, addr string) *shardStatus {
+	return &shardStatus{
+		s: ShardStatus{
+			Label: label,
+			Addr:  addr,
+		},
+		ready:     make(chan struct{}),
+		connected: make(chan struct{}),
+	}
+}
+
+func (st *shardStatus) get() ShardStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.s
+}
+
+// event updates the status for a connection event.
+func (st *shardStatus) event(e Event) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch e.Type {
+	case EventConnected:
+		st.s.Connected = true
+		st.readyOnce.Do(func() { close(st.ready) })
+		st.gen++
+		close(st.connected)
+		st.connected = make(chan struct{})
+	case EventDialFailed, EventHandshakeFailed, EventDisconnected:
+		st.s.Connected = false
+		st.s.LastError = e.Err
+		st.s.LastErrorTime = e.Time
+	case EventClosed:
+		st.s.Connected = false
+	}
+}
+
+// connGen gives the number of connects so far, and a channel which is closed
+// on the next one.
+func (st *shardStatus) connGen() (int, <-chan struct{}) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.gen, st.connected
+}
+
+// fail records a health check error.
+func (st *shardStatus) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.s.LastError = err
+	st.s.LastErrorTime = time.Now()
+}
+
+// success records a complete batch. rtt is only non-zero for health checks.
+func (st *shardStatus) success(rtt time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.s.LastSuccess = time.Now()
+	if rtt != 0 {
+		st.s.RTT = rtt
+	}
+}
+
+// Status gives the state of every shard, sorted by label.
+func (s *Shred) Status() []ShardStatus {
+	var res []ShardStatus
+	for i, sh := range s.shards {
+		st := sh.status.get()
+		st.Breaker = sh.breaker.getState()
+		st.QueueDepth = len(sh.conn)
+		if s.near != nil {
+			st.Tracking = s.near.tracking(i)
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Label < res[j].Label })
+	return res
+}
+
+// WaitReady blocks until every shard has connected, including the handshake
+// (AUTH), at least once. It gives an error if ctx is done before that.
+func (s *Shred) WaitReady(ctx context.Context) error {
+	return s.waitReady(ctx, len(s.shards))
+}
+
+// waitReady waits until n shards have connected.
+func (s *Shred) waitReady(ctx context.Context, n int) error {
+	var (
+		readyc = make(chan struct{}, len(s.shards))
+		done   = make(chan struct{})
+	)
+	defer close(done)
+	for _, sh := range s.shards {
+		go func(ready <-chan struct{}) {
+			select {
+			case <-ready:
+				readyc <- struct{}{}
+			case <-done:
+			}
+		}(sh.status.ready)
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-readyc:
+		case <-ctx.Done():
+			return s.notReady(ctx.Err())
+		}
+	}
+	return nil
+}
+
+// notReady makes an error listing all shards which didn't connect yet.
+func (s *Shred) notReady(err error) error {
+	var msgs []string
+	for _, sh := range s.shards {
+		select {
+		case <-sh.status.ready:
+			continue
+		default:
+		}
+		st := sh.status.get()
+		msg := fmt.Sprintf("%s (%s)", st.Label, st.Addr)
+		if st.LastError != nil {
+			msg += ": " + st.LastError.Error()
+		}
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("shredis: %w. Not connected: %s", err, strings.Join(msgs, ", "))
+}
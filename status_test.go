@@ -0,0 +1,105 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+func TestStatus(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	addr := mr.Addr()
+
+	shr := New(map[string]string{
+		"shard0": addr,
+		"shard1": "localhost:999999",
+	}, OptionHealthCheck(10*time.Millisecond))
+	defer shr.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	st := shr.Status()
+	if have, want := len(st), 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+	if have, want := st[0].Label, "shard0"; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := st[0].Addr, addr; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if !st[0].Connected {
+		t.Fatalf("not connected")
+	}
+	if st[0].LastError != nil {
+		t.Fatalf("unexpected error: %v", st[0].LastError)
+	}
+	if st[0].LastSuccess.IsZero() {
+		t.Fatalf("no success")
+	}
+	if st[0].RTT == 0 {
+		t.Fatalf("no RTT")
+	}
+	if st[1].Connected {
+		t.Fatalf("connected")
+	}
+	if st[1].LastError == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// the health check finds broken connections.
+	mr.Close()
+	time.Sleep(50 * time.Millisecond)
+	st = shr.Status()
+	if st[0].Connected {
+		t.Fatalf("connected")
+	}
+	if st[0].LastError == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	shr := New(map[string]string{
+		"shard0": mr.Addr(),
+	})
+	defer shr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shr.WaitReady(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	broken := New(map[string]string{
+		"shard0": mr.Addr(),
+		"shard1": "localhost:999999",
+	})
+	defer broken.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = broken.WaitReady(ctx)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if have, want := err.Error(), "shard1 (localhost:999999)"; !strings.Contains(have, want) {
+		t.Fatalf("have %q, want %q in there", have, want)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,399 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultConsumerBlock = 5 * time.Second
+
+// StreamEntry is a single entry of a stream. Fields is nil for entries which
+// were deleted, but are still in the pending list of a consumer group.
+type StreamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// Stream are the entries read from a single stream, by XREAD or XREADGROUP.
+type Stream struct {
+	Key     string
+	Entries []StreamEntry
+}
+
+// BuildXadd builds an XADD command. Use "*" as id to let redis pick one.
+// Fields are sorted.
+func BuildXadd(key, id string, values map[string]string) *Cmd {
+	fields := make([]string, 0, len(values))
+	for f := range values {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	args := make([]string, 0, 3+2*len(values))
+	args = append(args, "XADD", key, id)
+	for _, f := range fields {
+		args = append(args, f, values[f])
+	}
+	return Build(key, args...)
+}
+
+// BuildXrange builds an XRANGE command. A count of 0 means no limit. Use
+// GetStreamEntries() for the result.
+func BuildXrange(key, start, end string, count int) *Cmd {
+	args := []string{"XRANGE", key, start, end}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+	return Build(key, args...)
+}
+
+// BuildXrevrange builds an XREVRANGE command. A count of 0 means no limit.
+// Use GetStreamEntries() for the result.
+func BuildXrevrange(key, end, start string, count int) *Cmd {
+	args := []string{"XREVRANGE", key, end, start}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+	return Build(key, args...)
+}
+
+// BuildXlen is shorthand for Build(key, "XLEN", key)
+func BuildXlen(key string) *Cmd {
+	return Build(key, "XLEN", key)
+}
+
+// BuildXack builds an XACK command
+func BuildXack(key, group string, ids ...string) *Cmd {
+	return Build(key, append([]string{"XACK", key, group}, ids...)...)
+}
+
+// BuildXgroupCreate builds an XGROUP CREATE command. Use "$" as id to only
+// get new entries, and "0" for all.
+func BuildXgroupCreate(key, group, id string, mkstream bool) *Cmd {
+	args := []string{"XGROUP", "CREATE", key, group, id}
+	if mkstream {
+		args = append(args, "MKSTREAM")
+	}
+	return Build(key, args...)
+}
+
+// BuildXclaim builds an XCLAIM command. Use GetStreamEntries() for the
+// result.
+func BuildXclaim(key, group, consumer string, minIdle time.Duration, ids ...string) *Cmd {
+	args := []string{"XCLAIM", key, group, consumer, FormatMs(minIdle)}
+	return Build(key, append(args, ids...)...)
+}
+
+// BuildXautoclaim builds an XAUTOCLAIM command. A count of 0 uses redis'
+// default. Use GetAutoclaim() for the result.
+func BuildXautoclaim(key, group, consumer string, minIdle time.Duration, start string, count int) *Cmd {
+	args := []string{"XAUTOCLAIM", key, group, consumer, FormatMs(minIdle), start}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+	return Build(key, args...)
+}
+
+// GetStreamEntries returns the value of XRANGE, XREVRANGE, and XCLAIM.
+func (c *Cmd) GetStreamEntries() ([]StreamEntry, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return nil, err
+	}
+	return resStreamEntries(c.res)
+}
+
+// GetAutoclaim returns the value of XAUTOCLAIM: the id for the next call, and
+// the claimed entries.
+func (c *Cmd) GetAutoclaim() (string, []StreamEntry, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return "", nil, err
+	}
+	s, ok := c.res.([]interface{})
+	if !ok || len(s) < 2 {
+		return "", nil, fmt.Errorf("unexpected value. have %T, want []interface{}", c.res)
+	}
+	next, err := resString(s[0])
+	if err != nil {
+		return "", nil, err
+	}
+	es, err := resStreamEntries(s[1])
+	return next, es, err
+}
+
+// GetStreams returns the value of XREAD and XREADGROUP. It's empty if there
+// was nothing to read.
+func (c *Cmd) GetStreams() ([]Stream, error) {
+	err := c.err
+	c.err = ErrAlreadyGot
+	if err != nil {
+		return nil, err
+	}
+	if c.res == nil {
+		return nil, nil
+	}
+	s, ok := c.res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected value. have %T, want []interface{}", c.res)
+	}
+	var res []Stream
+	for _, v := range s {
+		kv, ok := v.([]interface{})
+		if !ok || len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected stream value. have %v", v)
+		}
+		key, err := resString(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		es, err := resStreamEntries(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Stream{Key: key, Entries: es})
+	}
+	return res, nil
+}
+
+func resStreamEntries(x interface{}) ([]StreamEntry, error) {
+	if x == nil {
+		return nil, nil
+	}
+	s, ok := x.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected value. have %T, want []interface{}", x)
+	}
+	res := make([]StreamEntry, 0, len(s))
+	for _, v := range s {
+		if v == nil {
+			// XCLAIM on deleted entries, in old redis versions.
+			continue
+		}
+		e, ok := v.([]interface{})
+		if !ok || len(e) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry. have %v", v)
+		}
+		id, err := resString(e[0])
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{ID: id}
+		if fs, ok := e[1].([]interface{}); ok {
+			entry.Fields = make(map[string]string, len(fs)/2)
+			for len(fs) > 1 {
+				k, err := resString(fs[0])
+				if err != nil {
+					return nil, err
+				}
+				v, err := resString(fs[1])
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields[k] = v
+				fs = fs[2:]
+			}
+		}
+		res = append(res, entry)
+	}
+	return res, nil
+}
+
+// ConsumerConfig configures Shred.Consume.
+type ConsumerConfig struct {
+	// Group and Consumer are the consumer group and the name of this
+	// consumer. The group has to exist, see BuildXgroupCreate.
+	Group, Consumer string
+	// Streams are the keys of the streams to read.
+	Streams []string
+	// Count is the maximum number of entries per read. 0 is no limit.
+	Count int
+	// Block is how long a single XREADGROUP waits for new entries. Defaults
+	// to 5 seconds.
+	Block time.Duration
+}
+
+// ConsumerHandler handles a single stream entry. The entry is acknowledged with
+// XACK if it returns nil, otherwise it stays in the pending list.
+type ConsumerHandler func(stream string, e StreamEntry) error
+
+// Consume reads new entries with XREADGROUP, until ctx is done or the Shred is
+// closed. Every shard with one of the streams gets its own connection and
+// goroutine, so the blocking reads don't hold up Exec(). handle is called from
+// those goroutines, in order per shard.
+// Entries which were read before but never acked, such as when handle failed,
+// are handled again first, on start and after every reconnect.
+// Connection errors are retried, with the backoff from OptionBackoff. Consume
+// returns nil when ctx is done, ErrClosed after Close(), or the error when
+// redis replies with one (such as NOGROUP).
+func (s *Shred) Consume(ctx context.Context, cfg ConsumerConfig, handle ConsumerHandler) error {
+	if len(cfg.Streams) == 0 {
+		return errors.New("shredis: no streams")
+	}
+	if cfg.Block <= 0 {
+		cfg.Block = defaultConsumerBlock
+	}
+
+	var (
+		order    []string
+		byShard  = map[string]shard{}
+		streams  = map[string][]string{}
+		firstErr error
+		errOnce  sync.Once
+		wg       sync.WaitGroup
+	)
+	for _, key := range cfg.Streams {
+		sh := s.shardFor(key)
+		if _, ok := byShard[sh.label]; !ok {
+			order = append(order, sh.label)
+			byShard[sh.label] = sh
+		}
+		streams[sh.label] = append(streams[sh.label], key)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closing:
+			errOnce.Do(func() { firstErr = ErrClosed })
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, label := range order {
+		wg.Add(1)
+		go func(sh shard, keys []string) {
+			defer wg.Done()
+			if err := s.consumeShard(ctx, sh, keys, cfg, handle); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(byShard[label], streams[label])
+	}
+	wg.Wait()
+	// the close watcher might still be running
+	errOnce.Do(func() {})
+	return firstErr
+}
+
+// consumeShard is Consume for the streams of a single shard. It returns nil
+// when ctx is done.
+// On start and after every reconnect it first reads this consumer's pending
+// entries (ID "0" and up), which were delivered before but never acked. Only
+// then does it read new entries with ">".
+func (s *Shred) consumeShard(ctx context.Context, sh shard, keys []string, cfg ConsumerConfig, handle ConsumerHandler) error {
+	var (
+		b  = newBackoff(s.backoffMin, s.backoffMax)
+		dc *dconn
+		// pending is the ID per key to read the pending entries after. It's
+		// nil once they are all read.
+		pending map[string]string
+	)
+	defer func() {
+		if dc != nil {
+			dc.close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if dc == nil {
+			var err error
+			dc, err = s.dial(ctx, sh.addr)
+			if err != nil {
+				var rerr *RedisError
+				if errors.As(err, &rerr) {
+					return fmt.Errorf("shredis: %w", err)
+				}
+				sleep(ctx, b.next())
+				continue
+			}
+			b.reset()
+			pending = make(map[string]string, len(keys))
+			for _, k := range keys {
+				pending[k] = "0"
+			}
+		}
+
+		read := buildXreadgroup(keys, cfg, pending)
+		if err := dc.do(ctx, read, cfg.Block+connTimeout); err != nil {
+			dc.close()
+			dc = nil
+			continue
+		}
+		res, err := read.GetStreams()
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			done := true
+			for _, st := range res {
+				if n := len(st.Entries); n > 0 {
+					pending[st.Key] = st.Entries[n-1].ID
+					done = false
+				}
+			}
+			if done {
+				pending = nil
+			}
+		}
+		for _, st := range res {
+			var ack []string
+			for _, e := range st.Entries {
+				if err := handle(st.Key, e); err == nil {
+					ack = append(ack, e.ID)
+				}
+			}
+			if len(ack) == 0 {
+				continue
+			}
+			// handled entries are acked, even if ctx is done by now
+			if err := dc.do(context.Background(), BuildXack(st.Key, cfg.Group, ack...), connTimeout); err != nil {
+				// they stay pending
+				dc.close()
+				dc = nil
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// buildXreadgroup builds the XREADGROUP for Consume. It reads the pending
+// entries after the IDs in pending, or new entries if pending is nil.
+func buildXreadgroup(keys []string, cfg ConsumerConfig, pending map[string]string) *Cmd {
+	args := []string{"XREADGROUP", "GROUP", cfg.Group, cfg.Consumer}
+	if cfg.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(cfg.Count))
+	}
+	if pending == nil {
+		args = append(args, "BLOCK", FormatMs(cfg.Block))
+	}
+	args = append(args, "STREAMS")
+	args = append(args, keys...)
+	for _, k := range keys {
+		id := ">"
+		if pending != nil {
+			id = pending[k]
+		}
+		args = append(args, id)
+	}
+	return Build("", args...)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,272 @@
+package shredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/shredis/internal/redistest"
+)
+
+func TestStreamBuilds(t *testing.T) {
+	for _, c := range []struct {
+		have    *Cmd
+		payload []string
+	}{
+		{
+			have:    BuildXadd("s", "*", map[string]string{"b": "2", "a": "1"}),
+			payload: []string{"XADD", "s", "*", "a", "1", "b", "2"},
+		},
+		{
+			have:    BuildXrange("s", "-", "+", 10),
+			payload: []string{"XRANGE", "s", "-", "+", "COUNT", "10"},
+		},
+		{
+			have:    BuildXrevrange("s", "+", "-", 0),
+			payload: []string{"XREVRANGE", "s", "+", "-"},
+		},
+		{
+			have:    BuildXack("s", "g", "1-0", "2-0"),
+			payload: []string{"XACK", "s", "g", "1-0", "2-0"},
+		},
+		{
+			have:    BuildXclaim("s", "g", "c", 1500*time.Millisecond, "1-0"),
+			payload: []string{"XCLAIM", "s", "g", "c", "1500", "1-0"},
+		},
+		{
+			have:    BuildXautoclaim("s", "g", "c", time.Second, "0-0", 5),
+			payload: []string{"XAUTOCLAIM", "s", "g", "c", "1000", "0-0", "COUNT", "5"},
+		},
+		{
+			have:    BuildXgroupCreate("s", "g", "$", true),
+			payload: []string{"XGROUP", "CREATE", "s", "g", "$", "MKSTREAM"},
+		},
+	} {
+		if have, want := string(c.have.payload), string(buildCommand(c.payload, nil)); have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+	}
+}
+
+func TestGetStreams(t *testing.T) {
+	entries := []interface{}{
+		[]interface{}{"1-0", []interface{}{"f", "v"}},
+		[]interface{}{"2-0", nil},
+	}
+	want := []StreamEntry{
+		{ID: "1-0", Fields: map[string]string{"f": "v"}},
+		{ID: "2-0"},
+	}
+
+	es, err := (&Cmd{res: entries}).GetStreamEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := es; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	next, es, err := (&Cmd{res: []interface{}{"3-0", entries, []interface{}{}}}).GetAutoclaim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "3-0" || !reflect.DeepEqual(es, want) {
+		t.Errorf("have: %v %v, want: 3-0 %v", next, es, want)
+	}
+
+	ss, err := (&Cmd{res: []interface{}{[]interface{}{"s", entries}}}).GetStreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := ss, []Stream{{Key: "s", Entries: want}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if _, err := (&Cmd{res: []interface{}{"foo"}}).GetStreamEntries(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestConsume(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		reads int
+		acks  [][]string
+	)
+	l := redistest.NewServer(t, func(_ *redistest.Conn, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "XREADGROUP":
+			reads++
+			if reads == 1 {
+				return "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n" +
+					"*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$2\r\nok\r\n" +
+					"*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$4\r\nfail\r\n"
+			}
+			time.Sleep(5 * time.Millisecond) // BLOCK
+			return "*-1\r\n"
+		case "XACK":
+			acks = append(acks, args)
+			return ":1\r\n"
+		default:
+			return "-ERR unexpected\r\n"
+		}
+	})
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	defer shutdownNow(shr)
+
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		seen        []string
+	)
+	err := shr.Consume(ctx, ConsumerConfig{
+		Group:    "g",
+		Consumer: "c",
+		Streams:  []string{"s"},
+		Block:    10 * time.Millisecond,
+	}, func(stream string, e StreamEntry) error {
+		seen = append(seen, stream+"/"+e.ID)
+		if e.Fields["f"] == "fail" {
+			cancel()
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := seen, []string{"s/1-0", "s/2-0"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := acks, [][]string{{"XACK", "s", "g", "1-0"}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestConsumeError(t *testing.T) {
+	l := redistest.NewServer(t, func(_ *redistest.Conn, args []string) string {
+		return "-NOGROUP No such key 's' or consumer group 'g'\r\n"
+	})
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	})
+	defer shutdownNow(shr)
+
+	err := shr.Consume(context.Background(), ConsumerConfig{
+		Group:    "g",
+		Consumer: "c",
+		Streams:  []string{"s"},
+	}, func(string, StreamEntry) error { return nil })
+	if !errors.Is(err, &RedisError{Prefix: "NOGROUP"}) {
+		t.Fatalf("have %v, want a NOGROUP error", err)
+	}
+}
+
+func TestConsumePending(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ids []string
+		// pending is this consumer's pending list, fresh is the entry which
+		// isn't read yet.
+		pending = []string{"1-0", "2-0"}
+		fresh   = []string{"3-0"}
+	)
+	entries := func(es []string) string {
+		r := fmt.Sprintf("*1\r\n*2\r\n$1\r\ns\r\n*%d\r\n", len(es))
+		for _, id := range es {
+			r += fmt.Sprintf("*2\r\n$3\r\n%s\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n", id)
+		}
+		return r
+	}
+	l := redistest.NewServer(t, func(_ *redistest.Conn, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "XREADGROUP":
+			id := args[len(args)-1]
+			ids = append(ids, id)
+			if id != ">" {
+				// COUNT 1
+				for _, p := range pending {
+					if p > id {
+						return entries([]string{p})
+					}
+				}
+				return entries(nil)
+			}
+			if len(fresh) > 0 {
+				pending = append(pending, fresh...)
+				r := entries(fresh)
+				fresh = nil
+				return r
+			}
+			// breaks the connection
+			return "?\r\n"
+		case "XACK":
+			for i, p := range pending {
+				if p == args[3] {
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+			return ":1\r\n"
+		default:
+			return "-ERR unexpected\r\n"
+		}
+	})
+	defer l.Close()
+
+	shr := New(map[string]string{
+		"shard0": l.Addr(),
+	}, OptionBackoff(time.Millisecond, 10*time.Millisecond))
+	defer shutdownNow(shr)
+
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		seen        []string
+	)
+	err := shr.Consume(ctx, ConsumerConfig{
+		Group:    "g",
+		Consumer: "c",
+		Streams:  []string{"s"},
+		Count:    1,
+		Block:    10 * time.Millisecond,
+	}, func(stream string, e StreamEntry) error {
+		seen = append(seen, e.ID)
+		switch len(seen) {
+		case 2:
+			return errors.New("failed")
+		case 4:
+			cancel()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 2-0 failed, and is read again after the reconnect
+	if have, want := seen, []string{"1-0", "2-0", "3-0", "2-0"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := ids, []string{"0", "1-0", "2-0", ">", ">", "0"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if len(pending) != 0 {
+		t.Errorf("still pending: %v", pending)
+	}
+}